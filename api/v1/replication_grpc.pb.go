@@ -0,0 +1,141 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.23.3
+// source: api/v1/replication.proto
+
+package log_v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Replication_Replicate_FullMethodName = "/log.v1.Replication/Replicate"
+)
+
+// ReplicationClient is the client API for Replication service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReplicationClient interface {
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (Replication_ReplicateClient, error)
+}
+
+type replicationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReplicationClient(cc grpc.ClientConnInterface) ReplicationClient {
+	return &replicationClient{cc}
+}
+
+func (c *replicationClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (Replication_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Replication_ServiceDesc.Streams[0], Replication_Replicate_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &replicationReplicateClient{stream}
+	return x, nil
+}
+
+type Replication_ReplicateClient interface {
+	Send(*ReplicateRequest) error
+	Recv() (*ReplicateResponse, error)
+	grpc.ClientStream
+}
+
+type replicationReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *replicationReplicateClient) Send(m *ReplicateRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *replicationReplicateClient) Recv() (*ReplicateResponse, error) {
+	m := new(ReplicateResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplicationServer is the server API for Replication service.
+// All implementations must embed UnimplementedReplicationServer
+// for forward compatibility
+type ReplicationServer interface {
+	Replicate(Replication_ReplicateServer) error
+	mustEmbedUnimplementedReplicationServer()
+}
+
+// UnimplementedReplicationServer must be embedded to have forward compatible implementations.
+type UnimplementedReplicationServer struct {
+}
+
+func (UnimplementedReplicationServer) Replicate(Replication_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedReplicationServer) mustEmbedUnimplementedReplicationServer() {}
+
+// UnsafeReplicationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReplicationServer will
+// result in compilation errors.
+type UnsafeReplicationServer interface {
+	mustEmbedUnimplementedReplicationServer()
+}
+
+func RegisterReplicationServer(s grpc.ServiceRegistrar, srv ReplicationServer) {
+	s.RegisterService(&Replication_ServiceDesc, srv)
+}
+
+func _Replication_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReplicationServer).Replicate(&replicationReplicateServer{stream})
+}
+
+type Replication_ReplicateServer interface {
+	Send(*ReplicateResponse) error
+	Recv() (*ReplicateRequest, error)
+	grpc.ServerStream
+}
+
+type replicationReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *replicationReplicateServer) Send(m *ReplicateResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *replicationReplicateServer) Recv() (*ReplicateRequest, error) {
+	m := new(ReplicateRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Replication_ServiceDesc is the grpc.ServiceDesc for Replication service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Replication_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "log.v1.Replication",
+	HandlerType: (*ReplicationServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _Replication_Replicate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api/v1/replication.proto",
+}
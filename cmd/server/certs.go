@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tukki0210/proglog/internal/config"
+)
+
+// runCertsは、CAとサーバー、クライアントの証明書を作成し、
+// internal/configが読み込む名前で設定ディレクトリに書き込む
+func runCerts(args []string) error {
+	flags := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := flags.String("dir", config.Dir(), "directory to write the certificates to")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "comma-separated DNS names, IP addresses and URIs of the server")
+	clients := flags.String("clients", "root,nobody", "comma-separated common names of the client certificates")
+	node := flags.String("node", "node", "common name of the certificate nodes connect to peers with; empty to skip")
+	validity := flags.Duration("validity", 365*24*time.Hour, "validity of the server and client certificates")
+	caName := flags.String("ca-cn", "proglog CA", "common name of the CA")
+	caValidity := flags.Duration("ca-validity", 10*365*24*time.Hour, "validity of the CA certificate")
+	overwriteCA := flags.Bool("overwrite-ca", false, "replace the CA in dir with a new one; certificates it issued stop being trusted")
+	flags.Parse(args)
+
+	serverHosts := splitList(*hosts)
+	if len(serverHosts) == 0 {
+		return errors.New("certs: -hosts is empty")
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		return err
+	}
+	file := func(name string) string {
+		return filepath.Join(*dir, filepath.Base(name))
+	}
+
+	ca, err := loadOrCreateCA(file(config.CAFile), file(config.CAKeyFile), *caName, *caValidity, *overwriteCA)
+	if err != nil {
+		return err
+	}
+
+	server, err := ca.Issue(config.CertRequest{
+		CommonName: serverHosts[0],
+		Hosts:      serverHosts,
+		Validity:   *validity,
+		Server:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("certs: server: %w", err)
+	}
+	if err := server.WriteFiles(file(config.ServerCertFile), file(config.ServerKeyFile)); err != nil {
+		return err
+	}
+	fmt.Println("wrote", file(config.ServerCertFile))
+
+	for _, name := range splitList(*clients) {
+		client, err := ca.Issue(config.CertRequest{
+			CommonName: name,
+			Validity:   *validity,
+		})
+		if err != nil {
+			return fmt.Errorf("certs: client %s: %w", name, err)
+		}
+		// root-client.pemのように、コモンネームをファイル名にする
+		certFile := file(name + "-client.pem")
+		if err := client.WriteFiles(certFile, file(name+"-client-key.pem")); err != nil {
+			return err
+		}
+		fmt.Println("wrote", certFile)
+	}
+
+	if *node != "" {
+		// 転送元として信頼されるように、ノードの証明書にはNodeOUを入れる
+		peer, err := ca.Issue(config.CertRequest{
+			CommonName:          *node,
+			Validity:            *validity,
+			OrganizationalUnits: []string{config.NodeOU},
+		})
+		if err != nil {
+			return fmt.Errorf("certs: node: %w", err)
+		}
+		if err := peer.WriteFiles(file(config.NodeClientCertFile), file(config.NodeClientKeyFile)); err != nil {
+			return err
+		}
+		fmt.Println("wrote", file(config.NodeClientCertFile))
+	}
+	return nil
+}
+
+// loadOrCreateCAは、既存のCAがあれば読み込み、なければ作成して書き込む
+// 既存のCAを使うと、発行済みの証明書を使い続けたまま証明書を追加できる
+// CAを置き換えると発行済みの証明書が全て使えなくなるため、overwriteを指定した場合だけ置き換える
+func loadOrCreateCA(certFile, keyFile, name string, validity time.Duration, overwrite bool) (*config.KeyPair, error) {
+	ca, err := config.LoadKeyPair(certFile, keyFile)
+	switch {
+	case err == nil && !overwrite:
+		fmt.Println("using existing ca", certFile)
+		return ca, nil
+	case err == nil:
+		fmt.Println("replacing existing ca", certFile)
+	case !errors.Is(err, fs.ErrNotExist):
+		// 読めないCAを黙って置き換えないように、overwriteでもエラーにする
+		return nil, fmt.Errorf("certs: ca: %w", err)
+	}
+	ca, err = config.NewCA(name, validity)
+	if err != nil {
+		return nil, fmt.Errorf("certs: ca: %w", err)
+	}
+	if err := ca.WriteFiles(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	fmt.Println("wrote", certFile)
+	return ca, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -1,12 +1,204 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"syscall"
 
-	 "github.com/tukki0210/proglog/internal/server"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/tukki0210/proglog/internal/agent"
+)
+
+// systemdが終了の理由を区別できるように、LSBの終了コードを使う
+// 設定の誤りは再起動しても直らないので、RestartPreventExitStatus=2 6で再起動を止められる
+const (
+	exitOK            = 0
+	exitFailure       = 1
+	exitUsage         = 2
+	exitNotConfigured = 6
 )
 
+// versionは、リリースのビルドで -ldflags "-X main.version=v1.2.3" で設定する
+var version = "dev"
+
+const usage = `usage: proglog <command> [flags]
+
+commands:
+  serve         start the node (grpc, http and membership)
+  certs         create the ca, server and client certificates
+  config print  print the effective configuration
+  version       print the version
+
+Run "proglog <command> -h" for the flags of a command.
+`
+
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
-}
\ No newline at end of file
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "serve":
+		return serve(args)
+	case "certs":
+		if err := runCerts(args); err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		return exitOK
+	case "config":
+		if len(args) == 0 || args[0] != "print" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		return printConfig(args[1:])
+	case "version":
+		printVersion()
+		return exitOK
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		return exitUsage
+	}
+}
+
+// loadConfigは、設定を読み込む。失敗した場合は終了コードを返す
+func loadConfig(args []string) (*agent.Config, int) {
+	cfg, err := agent.Load(args)
+	if err == nil {
+		return cfg, exitOK
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return nil, exitOK
+	}
+	log.Print(err)
+	var usageErr *agent.UsageError
+	if errors.As(err, &usageErr) {
+		return nil, exitUsage
+	}
+	return nil, exitNotConfigured
+}
+
+// serveは、SIGINTかSIGTERMを受け取るまでノードを動かす
+// SIGHUPを受け取ったら、再起動せずにACLと証明書を読み直す
+func serve(args []string) int {
+	cfg, code := loadConfig(args)
+	if cfg == nil {
+		return code
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	// 起動中に受け取ったシグナルも取りこぼさないように、先に登録する
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	a, err := agent.New(cfg)
+	if err != nil {
+		logger.Error("failed to start", zap.Error(err))
+		return exitFailure
+	}
+	logger.Info("started",
+		zap.String("version", version),
+		zap.String("node_name", cfg.NodeName),
+		zap.String("rpc_addr", cfg.RPCAddr()),
+		zap.String("http_addr", cfg.HTTPAddr),
+	)
+
+	code = exitOK
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := a.Reload(); err != nil {
+					logger.Error("failed to reload", zap.Error(err))
+				} else {
+					logger.Info("reloaded acl and certificates")
+				}
+				continue
+			}
+			logger.Info("shutting down", zap.Stringer("signal", sig))
+			break wait
+		case err := <-a.Errors():
+			logger.Error("server stopped", zap.Error(err))
+			code = exitFailure
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	// 停止中にもう一度SIGINTかSIGTERMを受け取ったら、待たずに停止する
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+		}
+	}()
+	if err := a.Shutdown(ctx); err != nil {
+		logger.Error("failed to shut down gracefully", zap.Error(err))
+		return exitFailure
+	}
+	logger.Info("stopped")
+	return code
+}
+
+// printConfigは、既定値、設定ファイル、環境変数、フラグを反映した設定をYAMLで出力する
+func printConfig(args []string) int {
+	cfg, code := loadConfig(args)
+	if cfg == nil {
+		return code
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if err := enc.Close(); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func printVersion() {
+	revision := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				revision = s.Value
+			}
+		}
+	}
+	if revision != "" {
+		fmt.Printf("proglog %s (%s) %s\n", version, revision, runtime.Version())
+		return
+	}
+	fmt.Printf("proglog %s %s\n", version, runtime.Version())
+}
@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/audit"
+	"github.com/tukki0210/proglog/internal/auth"
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/discovery"
+	"github.com/tukki0210/proglog/internal/log"
+	"github.com/tukki0210/proglog/internal/server"
+)
+
+// policySyncIntervalは、他のノードのポリシーのスナップショットを取り込む間隔
+var policySyncInterval = 30 * time.Second
+
+// Agentは、1つのノードのログ、gRPCとHTTPのサーバー、メンバーシップを起動して停止する
+type Agent struct {
+	Config *Config
+
+	log        *log.Log
+	auditLog   *audit.Log
+	authorizer *auth.Authorizer
+	certs      *config.CertReloader
+	stopWatch  func()
+	// peerDialOptionsは、リーダーへの転送やレプリケーションで他のノードに接続するオプション
+	peerDialOptions []grpc.DialOption
+	health          *server.Health
+	membership      *discovery.Membership
+	// policyReplicaは、ゴシップを暗号化している場合だけ、ポリシーの変更を他のノードと共有する
+	policyReplica  *server.PolicyReplica
+	stopPolicySync func()
+	stopACLWatch   func()
+	leaders        leaderFinder
+	replicator     *replicator
+	replicas       *server.Replicas
+	serverConfig   *server.Config
+	grpcServer     *grpc.Server
+	httpServer     *http.Server
+
+	// errsは、サーバーが待ち受けをやめたときのエラーを伝える
+	errs         chan error
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// Newは、全てのコンポーネントを起動したAgentを返す
+// 途中で失敗した場合は、起動したコンポーネントを停止してエラーを返す
+func New(config *Config) (*Agent, error) {
+	a := &Agent{
+		Config: config,
+		errs:   make(chan error, 2),
+		health: server.NewHealth(
+			server.HealthLog,
+			server.HealthMembership,
+			server.HealthReplication,
+		),
+	}
+	setup := []func() error{
+		a.setupLog,
+		a.setupAuthorizer,
+		a.setupTLS,
+		a.setupMembership,
+		a.setupReplication,
+		a.setupServers,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			_ = a.Shutdown(context.Background())
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// データディレクトリの下に、用途ごとのディレクトリを作る
+func (a *Agent) dataDir(name string) (string, error) {
+	dir := filepath.Join(a.Config.DataDir, name)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+func (a *Agent) setupLog() error {
+	dir, err := a.dataDir("log")
+	if err != nil {
+		return err
+	}
+	if a.log, err = log.NewLog(dir, a.Config.LogConfig()); err != nil {
+		return err
+	}
+	if dir, err = a.dataDir("audit"); err != nil {
+		return err
+	}
+	if a.auditLog, err = audit.New(dir, audit.Config{MaxBytes: a.Config.Audit.MaxBytes}); err != nil {
+		return err
+	}
+	a.health.SetHealthy(server.HealthLog, true)
+	return nil
+}
+
+// setupAuthorizerは、Adminサービスで変更したポリシーをデータディレクトリに保存する
+// 設定のポリシーのファイルは、初めて起動したときの初期値として使い、その後に追加・削除した
+// ルールはReloadでデータディレクトリのポリシーに反映する
+func (a *Agent) setupAuthorizer() error {
+	dir, err := a.dataDir("acl")
+	if err != nil {
+		return err
+	}
+	if a.authorizer, err = auth.NewPersistent(a.Config.ACL.ModelFile, a.Config.ACL.PolicyFile, dir); err != nil {
+		return err
+	}
+	if a.Config.ACL.ReloadInterval > 0 {
+		a.stopACLWatch = a.authorizer.Watch(a.Config.ACL.ReloadInterval)
+	}
+	return nil
+}
+
+func (a *Agent) setupTLS() error {
+	var err error
+	if a.certs, err = config.NewCertReloader(a.Config.ServerTLSConfig()); err != nil {
+		return err
+	}
+	if a.Config.TLS.ReloadInterval > 0 {
+		a.stopWatch = a.certs.Watch(a.Config.TLS.ReloadInterval)
+	}
+	peerTLS, err := config.SetupTLSConfig(a.Config.PeerTLSConfig())
+	if err != nil {
+		return err
+	}
+	a.peerDialOptions = []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLS)),
+	}
+	return nil
+}
+
+func (a *Agent) setupMembership() error {
+	var err error
+	a.membership, err = discovery.New(nil, a.Config.DiscoveryConfig())
+	if err != nil {
+		return err
+	}
+	// ユーザーイベントとクエリは認証されないので、暗号化していないゴシップでは
+	// ポリシーの変更を受け付けず、Adminサービスでの変更はこのノードだけに適用する
+	if a.membership.Encrypted() {
+		a.policyReplica = server.NewPolicyReplica(a.authorizer)
+		a.membership.RegisterEventHandler(server.PolicyEventName, a.policyReplica.HandleEvent)
+		a.membership.RegisterQueryHandler(server.PolicySnapshotQueryName, a.policyReplica.HandleSnapshotQuery)
+		a.stopPolicySync = a.policyReplica.Watch(policySnapshots{a.membership}, policySyncInterval)
+	}
+	a.health.SetHealthy(server.HealthMembership, true)
+	return nil
+}
+
+// setupReplicationは、フォロワーではリーダーのログを複製し、リーダーではACKS_ALLの
+// 書き込みでフォロワーの複製を待てるようにする
+func (a *Agent) setupReplication() error {
+	a.leaders = leaderFinder{membership: a.membership, name: a.Config.NodeName}
+	a.replicator = newReplicator(a.leaders, a.log, a.health, a.peerDialOptions)
+	a.replicas = server.NewReplicas()
+	return nil
+}
+
+func (a *Agent) setupServers() error {
+	sc, err := a.Config.ServerConfig()
+	if err != nil {
+		return err
+	}
+	sc.CommitLog = a.log
+	sc.AdminLog = a.log
+	sc.Authorizer = a.authorizer
+	sc.PolicyManager = a.authorizer
+	if a.policyReplica != nil {
+		sc.PolicyBroadcaster = a.membership
+	}
+	sc.AuditLog = a.auditLog
+	sc.GetServerer = memberServers{a.leaders}
+	sc.LeaderFinder = a.leaders
+	sc.ForwardDialOptions = a.peerDialOptions
+	sc.ReplicationWaiter = replicationWaiter{leaders: a.leaders, replicas: a.replicas}
+	sc.Replicas = a.replicas
+	sc.Health = a.health
+	sc.Drainer = server.NewDrainer()
+	a.serverConfig = sc
+
+	rpcLn, err := net.Listen("tcp", a.Config.RPCAddr())
+	if err != nil {
+		return err
+	}
+	creds := credentials.NewTLS(a.certs.TLSConfig())
+	if a.grpcServer, err = server.NewGRPCServer(sc, grpc.Creds(creds)); err != nil {
+		rpcLn.Close()
+		return err
+	}
+	httpLn, err := net.Listen("tcp", a.Config.HTTPAddr)
+	if err != nil {
+		rpcLn.Close()
+		return err
+	}
+	a.httpServer = server.NewHTTPServer(a.Config.HTTPAddr, sc)
+	a.httpServer.TLSConfig = a.certs.TLSConfig()
+
+	go func() {
+		if err := a.grpcServer.Serve(rpcLn); err != nil {
+			a.errs <- fmt.Errorf("grpc server: %w", err)
+		}
+	}()
+	go func() {
+		if err := a.httpServer.ServeTLS(httpLn, "", ""); !errors.Is(err, http.ErrServerClosed) {
+			a.errs <- fmt.Errorf("http server: %w", err)
+		}
+	}()
+	return nil
+}
+
+// Errorsは、サーバーが予期せず待ち受けをやめたときのエラーを受け取るチャネルを返す
+func (a *Agent) Errors() <-chan error {
+	return a.errs
+}
+
+// Reloadは、ACLと証明書を読み直す
+func (a *Agent) Reload() error {
+	return errors.Join(a.authorizer.Reload(), a.certs.Reload())
+}
+
+// Shutdownは、クラスタから離脱し、ストリームをドレインしてからサーバーとログを停止する
+// ctxが終わるまでに停止しない場合は、残りの接続を強制的に閉じる。複数回呼んでも問題ない
+func (a *Agent) Shutdown(ctx context.Context) error {
+	a.shutdownOnce.Do(func() {
+		var errs []error
+		if a.stopPolicySync != nil {
+			a.stopPolicySync()
+		}
+		// 複製はログに追記するので、ログを閉じる前に止める
+		if a.replicator != nil {
+			a.replicator.Close()
+		}
+		if a.membership != nil {
+			errs = append(errs, a.membership.Leave(), a.membership.Shutdown())
+		}
+		if a.httpServer != nil {
+			// http.Server.ShutdownはWebSocketの接続を待たないため、HTTPのストリームも
+			// Drainerに登録して、ドレインで終わらせてから待つ
+			a.serverConfig.Drainer.Drain()
+			if err := a.serverConfig.Drainer.Wait(ctx); err != nil {
+				errs = append(errs, err)
+			}
+			if err := a.httpServer.Shutdown(ctx); err != nil {
+				errs = append(errs, err, a.httpServer.Close())
+			}
+		}
+		// GracefulStopがコミットログを閉じる
+		if a.grpcServer != nil {
+			errs = append(errs, server.GracefulStop(ctx, a.grpcServer, a.serverConfig))
+		} else if a.log != nil {
+			errs = append(errs, a.log.Close())
+		}
+		if a.stopWatch != nil {
+			a.stopWatch()
+		}
+		if a.stopACLWatch != nil {
+			a.stopACLWatch()
+		}
+		if a.auditLog != nil {
+			errs = append(errs, a.auditLog.Close())
+		}
+		a.shutdownErr = errors.Join(errs...)
+	})
+	return a.shutdownErr
+}
+
+// policySnapshotsは、メンバーシップのクエリで他のノードのポリシーのスナップショットを集める
+type policySnapshots struct {
+	membership *discovery.Membership
+}
+
+func (p policySnapshots) PolicySnapshots() ([][]byte, error) {
+	responses, err := p.membership.Query(server.PolicySnapshotQueryName, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots [][]byte
+	for _, res := range responses {
+		// 応答できなかったノードは、次の取り込みで改めて問い合わせる
+		if res.Err == nil {
+			snapshots = append(snapshots, res.Payload)
+		}
+	}
+	return snapshots, nil
+}
+
+// memberServersは、メンバーシップの生存しているノードをGetServersで返す
+// クライアントのピッカーが書き込みを振り分けられるように、リーダーに印を付ける
+type memberServers struct {
+	leaders leaderFinder
+}
+
+func (m memberServers) GetServers() ([]*api.Server, error) {
+	leader, _ := m.leaders.leader()
+	var servers []*api.Server
+	for _, member := range m.leaders.members() {
+		servers = append(servers, &api.Server{
+			Id:       member.Name,
+			RpcAddr:  member.Tags["rpc_addr"],
+			IsLeader: member.Name == leader.Name,
+		})
+	}
+	return servers, nil
+}
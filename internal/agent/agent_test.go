@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/loadbalance"
+	"github.com/tukki0210/proglog/internal/server"
+)
+
+func TestAgent(t *testing.T) {
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		agents = append(agents, startAgent(t, agents, nil))
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown(context.Background()))
+		}
+	}()
+
+	conn := dial(t, agents[0].Config.RPCAddr())
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+
+	// メンバーシップに参加したノードをGetServersで返し、名前が最も小さいノードをリーダーとする
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(ctx, &api.GetServersRequest{})
+		require.NoError(t, err)
+		if len(res.Servers) != 3 {
+			return false
+		}
+		for _, s := range res.Servers {
+			if s.IsLeader != (s.Id == agents[0].Config.NodeName) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// フォロワーも複製を始めると、レプリケーションが正常になる
+	for _, a := range agents {
+		require.Eventually(t, func() bool {
+			res, err := a.health.Check(ctx, &healthpb.HealthCheckRequest{
+				Service: server.HealthReplication,
+			})
+			require.NoError(t, err)
+			return res.Status == healthpb.HealthCheckResponse_SERVING
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+
+	// リゾルバとピッカーを使うクライアントは、書き込みをリーダーに、読み出しをフォロワーに送る
+	resolved := dial(t, fmt.Sprintf("%s:///%s", loadbalance.Name, agents[1].Config.RPCAddr()))
+	defer resolved.Close()
+	lbClient := api.NewLogClient(resolved)
+	produce, err := lbClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	// ACKS_ALLの書き込みは、全てのフォロワーに複製されてから応答する
+	for _, a := range agents[1:] {
+		record, err := a.log.Read(produce.Offset)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foo"), record.Value)
+	}
+	consume, err := lbClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consume.Record.Value)
+
+	// フォロワーに直接書き込んでも、リーダーに転送してから複製する
+	follower := dial(t, agents[2].Config.RPCAddr())
+	defer follower.Close()
+	produce, err = api.NewLogClient(follower).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("bar")},
+	})
+	require.NoError(t, err)
+	record, err := agents[0].log.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), record.Value)
+	require.Eventually(t, func() bool {
+		record, err := agents[1].log.Read(produce.Offset)
+		return err == nil && bytes.Equal(record.Value, []byte("bar"))
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// 停止したノードはGetServersから外れる
+	require.NoError(t, agents[2].Shutdown(context.Background()))
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(ctx, &api.GetServersRequest{})
+		require.NoError(t, err)
+		return len(res.Servers) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	select {
+	case err := <-agents[0].Errors():
+		t.Fatal(err)
+	default:
+	}
+}
+
+// リーダーとログが食い違ったフォロワーは、複製を拒否されてレプリケーションが正常にならない
+func TestAgentReplicationDiverged(t *testing.T) {
+	follower := startAgent(t, nil, func(c *Config) { c.NodeName = "node-1" })
+	defer follower.Shutdown(context.Background())
+	_, err := follower.log.Append(&api.Record{Value: []byte("diverged")})
+	require.NoError(t, err)
+
+	leader := startAgent(t, []*Agent{follower}, func(c *Config) { c.NodeName = "node-0" })
+	defer leader.Shutdown(context.Background())
+
+	ctx := context.Background()
+	replicating := func(a *Agent) bool {
+		res, err := a.health.Check(ctx, &healthpb.HealthCheckRequest{
+			Service: server.HealthReplication,
+		})
+		require.NoError(t, err)
+		return res.Status == healthpb.HealthCheckResponse_SERVING
+	}
+	require.Eventually(t, func() bool {
+		_, local, err := follower.leaders.Leader()
+		return err == nil && !local && !replicating(follower)
+	}, 3*time.Second, 50*time.Millisecond)
+	require.True(t, replicating(leader))
+	require.Never(t, func() bool { return replicating(follower) }, time.Second, 50*time.Millisecond)
+	require.Equal(t, uint64(1), follower.log.NextOffset())
+}
+
+// ゴシップを暗号化したクラスタでは、ポリシーの変更が全てのノードに伝わり、
+// 後から参加したノードもスナップショットで同じポリシーに揃う
+func TestAgentPolicyReplication(t *testing.T) {
+	defer func(interval time.Duration) { policySyncInterval = interval }(policySyncInterval)
+	policySyncInterval = 100 * time.Millisecond
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	encrypt := func(c *Config) { c.EncryptKeys = []string{key} }
+	var agents []*Agent
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown(context.Background()))
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		agents = append(agents, startAgent(t, agents, encrypt))
+	}
+
+	conn := dial(t, agents[0].Config.RPCAddr())
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	ctx := context.Background()
+	policy := &api.Policy{Subject: "nobody", Object: "orders", Action: "produce"}
+	_, err := admin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return agents[1].authorizer.Authorize("nobody", "orders", "produce") == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = admin.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	agents = append(agents, startAgent(t, agents, encrypt))
+	for _, a := range agents[1:] {
+		require.Eventually(t, func() bool {
+			return a.authorizer.Authorize("nobody", "orders", "produce") != nil
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	// 暗号化していないクラスタでは、ポリシーの変更を他のノードに伝えない
+	plain := startAgent(t, nil, nil)
+	defer plain.Shutdown(context.Background())
+	require.Nil(t, plain.policyReplica)
+	require.Nil(t, plain.serverConfig.PolicyBroadcaster)
+}
+
+// startAgentは、agentsの最初のノードに参加するAgentを起動する
+func startAgent(t *testing.T, agents []*Agent, fn func(*Config)) *Agent {
+	t.Helper()
+	ports := freePorts(t, 3)
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.NodeName = fmt.Sprintf("node-%d", len(agents))
+	cfg.BindAddr = fmt.Sprintf("127.0.0.1:%d", ports[0])
+	cfg.RPCPort = ports[1]
+	cfg.HTTPAddr = fmt.Sprintf("127.0.0.1:%d", ports[2])
+	cfg.ShutdownTimeout = 5 * time.Second
+	if len(agents) > 0 {
+		cfg.StartJoinAddrs = []string{agents[0].Config.BindAddr}
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	cfg.setFileDefaults()
+	require.NoError(t, cfg.Validate())
+
+	a, err := New(cfg)
+	require.NoError(t, err)
+	return a
+}
+
+// dialは、rootクライアントとしてtargetに接続する
+func dial(t *testing.T, target string) *grpc.ClientConn {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		target,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	return conn
+}
+
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	ports := make([]int, n)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+	}
+	return ports
+}
+
+func TestAgentReloadPolicy(t *testing.T) {
+	seed, err := os.ReadFile(config.ACLPolicyFile)
+	require.NoError(t, err)
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	write := func(rules string) {
+		content := append(append([]byte{}, seed...), rules...)
+		require.NoError(t, os.WriteFile(policyFile, content, 0600))
+	}
+	write("\n")
+	a := startAgent(t, nil, func(c *Config) {
+		c.ACL.PolicyFile = policyFile
+		c.ACL.ReloadInterval = 0
+	})
+	defer a.Shutdown(context.Background())
+
+	conn := dial(t, a.Config.RPCAddr())
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	policy := &api.Policy{Subject: "nobody", Object: "orders", Action: "consume"}
+	_, err = admin.AddPolicy(context.Background(), &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+
+	// SIGHUPと同じく読み直すと、設定のファイルの変更を反映し、Adminサービスの変更も残す
+	write("\np, nobody, *, produce\n")
+	require.NoError(t, a.Reload())
+	require.NoError(t, a.authorizer.Authorize("nobody", "orders", "produce"))
+	require.NoError(t, a.authorizer.Authorize("nobody", "orders", "consume"))
+
+	write("\n")
+	require.NoError(t, a.Reload())
+	require.Error(t, a.authorizer.Authorize("nobody", "orders", "produce"))
+	require.NoError(t, a.authorizer.Authorize("nobody", "orders", "consume"))
+}
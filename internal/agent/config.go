@@ -0,0 +1,443 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/discovery"
+	"github.com/tukki0210/proglog/internal/log"
+	"github.com/tukki0210/proglog/internal/server"
+)
+
+// envPrefixは、設定を上書きする環境変数の接頭辞
+// segment.max_store_bytesはPROGLOG_SEGMENT_MAX_STORE_BYTESで上書きする
+const envPrefix = "PROGLOG_"
+
+// Configは、ノードの設定
+// 既定値、設定ファイル(YAML)、環境変数、フラグの順に上書きする
+// 環境変数とフラグの名前は、YAMLのキーから作る
+type Config struct {
+	DataDir  string `yaml:"data_dir" usage:"directory to store the log in"`
+	NodeName string `yaml:"node_name" usage:"unique name of the node in the cluster"`
+	// BindAddrは、ゴシップで待ち受けるアドレス。RPCも同じホストで待ち受ける
+	BindAddr string `yaml:"bind_addr" usage:"address to bind serf on"`
+	RPCPort  int    `yaml:"rpc_port" usage:"port for grpc clients and peers"`
+	HTTPAddr string `yaml:"http_addr" usage:"address to serve the http api on"`
+
+	StartJoinAddrs []string `yaml:"start_join_addrs" usage:"comma-separated serf addresses to join"`
+	EncryptKeys    []string `yaml:"encrypt_keys" usage:"comma-separated base64 keys to encrypt gossip with"`
+	AllowedNodes   []string `yaml:"allowed_nodes" usage:"comma-separated node names allowed to join; requires encrypt_keys"`
+
+	Segment SegmentConfig `yaml:"segment"`
+	TLS     TLSConfig     `yaml:"tls"`
+	ACL     ACLConfig     `yaml:"acl"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Quota   QuotaConfig   `yaml:"quota"`
+	Audit   AuditConfig   `yaml:"audit"`
+
+	EnableReflection  bool          `yaml:"enable_reflection" usage:"register the grpc reflection service"`
+	TrustedForwarders []string      `yaml:"trusted_forwarders" usage:"comma-separated common names of node certificates allowed to forward requests"`
+	AckTimeout        time.Duration `yaml:"ack_timeout" usage:"default timeout for ACKS_ALL writes"`
+	// ShutdownTimeoutは、停止するときにストリームと接続の終了を待つ時間
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" usage:"time to wait for streams and connections on shutdown"`
+}
+
+type SegmentConfig struct {
+	MaxStoreBytes uint64 `yaml:"max_store_bytes" usage:"max bytes of a segment's store"`
+	MaxIndexBytes uint64 `yaml:"max_index_bytes" usage:"max bytes of a segment's index"`
+	InitialOffset uint64 `yaml:"initial_offset" usage:"offset of the first record"`
+}
+
+type AuditConfig struct {
+	// MaxBytesを超えた監査ログは、古いセグメントから削除する。0の場合は全て残す
+	MaxBytes uint64 `yaml:"max_bytes" usage:"max bytes of the audit log to keep, 0 keeps everything"`
+}
+
+// TLSConfigは、証明書のファイル。省略したファイルはDirの下の既定の名前を使う
+type TLSConfig struct {
+	Dir          string `yaml:"dir" usage:"directory of the certificates and acl files"`
+	CertFile     string `yaml:"cert_file" usage:"server certificate"`
+	KeyFile      string `yaml:"key_file" usage:"server private key"`
+	CAFile       string `yaml:"ca_file" usage:"ca certificate to verify clients and peers with"`
+	PeerCertFile string `yaml:"peer_cert_file" usage:"client certificate to connect to peers with"`
+	PeerKeyFile  string `yaml:"peer_key_file" usage:"client private key to connect to peers with"`
+	// ReloadIntervalは、証明書のファイルの変更を確認する間隔。0の場合は読み直さない
+	ReloadInterval time.Duration `yaml:"reload_interval" usage:"interval to check the certificates for changes"`
+}
+
+// ACLConfigは、ACLのファイル
+// ポリシーはデータディレクトリに保存し、PolicyFileで追加・削除したルールを起動時とSIGHUPで反映する
+type ACLConfig struct {
+	ModelFile  string `yaml:"model_file" usage:"casbin model"`
+	PolicyFile string `yaml:"policy_file" usage:"casbin policy"`
+	// ReloadIntervalは、ACLのファイルの変更を確認する間隔。0の場合はSIGHUPでだけ読み直す
+	ReloadInterval time.Duration `yaml:"reload_interval" usage:"interval to check the acl files for changes"`
+}
+
+type AuthConfig struct {
+	// SPIFFETrustDomainが設定されている場合、SPIFFE IDのパスをsubjectにする
+	SPIFFETrustDomain string `yaml:"spiffe_trust_domain" usage:"use the path of spiffe ids in this trust domain as subject"`
+	// Subjectsは、設定ファイルでのみ指定できるクライアント証明書のsubjectの取り出し方
+	Subjects []SubjectConfig `yaml:"subjects"`
+
+	JWKSFile    string `yaml:"jwks_file" usage:"jwks to verify bearer tokens with"`
+	JWTIssuer   string `yaml:"jwt_issuer" usage:"required iss claim of bearer tokens"`
+	JWTAudience string `yaml:"jwt_audience" usage:"required aud claim of bearer tokens"`
+	// APIKeysは、APIキーからsubjectへの対応
+	APIKeys map[string]string `yaml:"api_keys" usage:"comma-separated key=subject pairs"`
+}
+
+type SubjectConfig struct {
+	Source      string `yaml:"source"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+type QuotaConfig struct {
+	Default QuotaLimits `yaml:"default"`
+	// Subjectsは、設定ファイルでのみ指定できるsubjectごとの制限
+	Subjects map[string]QuotaLimits `yaml:"subjects"`
+}
+
+type QuotaLimits struct {
+	ProduceRequestsPerSecond float64 `yaml:"produce_requests_per_second" usage:"produce requests per second per subject"`
+	ProduceBytesPerSecond    float64 `yaml:"produce_bytes_per_second" usage:"produce bytes per second per subject"`
+	ConsumeRequestsPerSecond float64 `yaml:"consume_requests_per_second" usage:"consume requests per second per subject"`
+	ConsumeBytesPerSecond    float64 `yaml:"consume_bytes_per_second" usage:"consume bytes per second per subject"`
+}
+
+func (l QuotaLimits) limits() server.QuotaLimits {
+	return server.QuotaLimits(l)
+}
+
+// DefaultConfigは、設定ファイルなどで上書きする前の既定値を返す
+func DefaultConfig() *Config {
+	nodeName, _ := os.Hostname()
+	return &Config{
+		DataDir:         "data",
+		NodeName:        nodeName,
+		BindAddr:        "127.0.0.1:8401",
+		RPCPort:         8400,
+		HTTPAddr:        ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Audit: AuditConfig{
+			MaxBytes: 1 << 30,
+		},
+		// certsコマンドが発行するノードの証明書のコモンネーム
+		TrustedForwarders: []string{"node"},
+		TLS: TLSConfig{
+			Dir:            config.Dir(),
+			ReloadInterval: 10 * time.Second,
+		},
+		ACL: ACLConfig{
+			ReloadInterval: 10 * time.Second,
+		},
+	}
+}
+
+// Loadは、argsのフラグと環境変数、-configかPROGLOG_CONFIGの設定ファイルから設定を読み込む
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := DefaultConfig()
+	fields := c.fields()
+
+	flags := flag.NewFlagSet("proglog", flag.ContinueOnError)
+	file := flags.String("config", "", "path of the yaml config file")
+	// フラグは設定ファイルと環境変数の後で適用するため、値を取っておく
+	type flagValue struct {
+		field field
+		value string
+	}
+	var flagValues []flagValue
+	argNames := map[string]string{"config": "file"}
+	for _, f := range fields {
+		f := f
+		record := func(s string) error {
+			flagValues = append(flagValues, flagValue{f, s})
+			return nil
+		}
+		// boolは、-enable-reflectionのように値を省略して指定できるようにする
+		if f.value.Kind() == reflect.Bool {
+			flags.Var(boolFunc(record), f.flagName(), f.usage)
+		} else {
+			flags.Func(f.flagName(), f.usage, record)
+		}
+		argNames[f.flagName()] = f.argName()
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", flags.Name())
+		printDefaults(flags, argNames)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, &UsageError{err}
+	}
+	if flags.NArg() > 0 {
+		return nil, &UsageError{fmt.Errorf("unexpected arguments %q", flags.Args())}
+	}
+
+	if *file == "" {
+		*file, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *file != "" {
+		if err := c.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fields {
+		if v, ok := lookupEnv(f.envName()); ok {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.envName(), err)
+			}
+		}
+	}
+	for _, v := range flagValues {
+		if err := v.field.set(v.value); err != nil {
+			return nil, &UsageError{fmt.Errorf("-%s: %w", v.field.flagName(), err)}
+		}
+	}
+
+	c.setFileDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// UsageErrorは、フラグや引数の誤り。設定の値の誤りと区別して終了コードを変えるために使う
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string { return e.Err.Error() }
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// readFileは、YAMLの設定ファイルで上書きする。知らないキーはエラーにする
+func (c *Config) readFile(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// setFileDefaultsは、省略された証明書とACLのファイルをTLS.Dirの下の既定の名前にする
+func (c *Config) setFileDefaults() {
+	for _, f := range []struct {
+		name *string
+		def  string
+	}{
+		{&c.TLS.CertFile, config.ServerCertFile},
+		{&c.TLS.KeyFile, config.ServerKeyFile},
+		{&c.TLS.CAFile, config.CAFile},
+		{&c.TLS.PeerCertFile, config.NodeClientCertFile},
+		{&c.TLS.PeerKeyFile, config.NodeClientKeyFile},
+		{&c.ACL.ModelFile, config.ACLModelFile},
+		{&c.ACL.PolicyFile, config.ACLPolicyFile},
+	} {
+		if *f.name == "" {
+			*f.name = filepath.Join(c.TLS.Dir, filepath.Base(f.def))
+		}
+	}
+}
+
+// Validateは、設定の値を検証し、全ての誤りをまとめて返す
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.DataDir != "", "data_dir is required")
+	check(c.NodeName != "", "node_name is required")
+	_, _, err := net.SplitHostPort(c.BindAddr)
+	check(err == nil, "invalid bind_addr %q", c.BindAddr)
+	check(c.RPCPort > 0 && c.RPCPort < 65536, "invalid rpc_port %d", c.RPCPort)
+	_, _, err = net.SplitHostPort(c.HTTPAddr)
+	check(err == nil, "invalid http_addr %q", c.HTTPAddr)
+	check(c.AckTimeout >= 0, "invalid ack_timeout %s", c.AckTimeout)
+	check(c.ShutdownTimeout > 0, "invalid shutdown_timeout %s", c.ShutdownTimeout)
+	check(c.TLS.ReloadInterval >= 0, "invalid tls.reload_interval %s", c.TLS.ReloadInterval)
+	check(c.ACL.ReloadInterval >= 0, "invalid acl.reload_interval %s", c.ACL.ReloadInterval)
+	// ノード名は名乗るだけなので、キーを持つノードに限らないと許可リストを騙れる
+	check(len(c.AllowedNodes) == 0 || len(c.EncryptKeys) > 0,
+		"allowed_nodes requires encrypt_keys")
+
+	check(c.Auth.JWKSFile != "" || (c.Auth.JWTIssuer == "" && c.Auth.JWTAudience == ""),
+		"auth.jwt_issuer and auth.jwt_audience require auth.jwks_file")
+	for i, s := range c.Auth.Subjects {
+		_, err := server.ParseSubjectSource(s.Source)
+		check(err == nil, "auth.subjects[%d]: %v", i, err)
+		_, err = regexp.Compile(s.Pattern)
+		check(err == nil, "auth.subjects[%d]: invalid pattern: %v", i, err)
+	}
+
+	checkLimits := func(name string, l QuotaLimits) {
+		check(l.ProduceRequestsPerSecond >= 0 && l.ProduceBytesPerSecond >= 0 &&
+			l.ConsumeRequestsPerSecond >= 0 && l.ConsumeBytesPerSecond >= 0,
+			"%s: quota limits must not be negative", name)
+	}
+	checkLimits("quota.default", c.Quota.Default)
+	for subject, l := range c.Quota.Subjects {
+		checkLimits("quota.subjects."+subject, l)
+	}
+	return errors.Join(errs...)
+}
+
+// Redactedは、表示するために秘密の値を伏せた設定のコピーを返す
+func (c *Config) Redacted() *Config {
+	r := *c
+	if len(c.EncryptKeys) > 0 {
+		r.EncryptKeys = make([]string, len(c.EncryptKeys))
+		for i := range r.EncryptKeys {
+			r.EncryptKeys[i] = redacted
+		}
+	}
+	if len(c.Auth.APIKeys) > 0 {
+		// APIキーはマップのキーなので、subjectの順に番号を付けて伏せる
+		subjects := make([]string, 0, len(c.Auth.APIKeys))
+		for _, subject := range c.Auth.APIKeys {
+			subjects = append(subjects, subject)
+		}
+		sort.Strings(subjects)
+		r.Auth.APIKeys = make(map[string]string, len(subjects))
+		for i, subject := range subjects {
+			r.Auth.APIKeys[fmt.Sprintf("%s-%d", redacted, i+1)] = subject
+		}
+	}
+	return &r
+}
+
+const redacted = "<redacted>"
+
+// RPCAddrは、gRPCで待ち受けるアドレス
+func (c *Config) RPCAddr() string {
+	host, _, _ := net.SplitHostPort(c.BindAddr)
+	return net.JoinHostPort(host, strconv.Itoa(c.RPCPort))
+}
+
+func (c *Config) LogConfig() log.Config {
+	var lc log.Config
+	lc.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	lc.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	lc.Segment.IntialOffset = c.Segment.InitialOffset
+	return lc
+}
+
+// DiscoveryConfigは、他のノードがRPCAddrに接続できるようにタグを付ける
+func (c *Config) DiscoveryConfig() discovery.Config {
+	return discovery.Config{
+		NodeName:       c.NodeName,
+		BindAddr:       c.BindAddr,
+		Tags:           map[string]string{"rpc_addr": c.RPCAddr()},
+		StartJoinAddrs: c.StartJoinAddrs,
+		EncryptKeys:    c.EncryptKeys,
+		AllowedNodes:   c.AllowedNodes,
+	}
+}
+
+// ServerTLSConfigは、クライアントとピアからの接続を待ち受けるTLSの設定
+func (c *Config) ServerTLSConfig() config.TLSConfig {
+	return config.TLSConfig{
+		CertFile:      c.TLS.CertFile,
+		KeyFile:       c.TLS.KeyFile,
+		CAFile:        c.TLS.CAFile,
+		ServerAddress: c.RPCAddr(),
+		Server:        true,
+	}
+}
+
+// PeerTLSConfigは、リーダーへの転送などで他のノードに接続するTLSの設定
+func (c *Config) PeerTLSConfig() config.TLSConfig {
+	return config.TLSConfig{
+		CertFile: c.TLS.PeerCertFile,
+		KeyFile:  c.TLS.PeerKeyFile,
+		CAFile:   c.TLS.CAFile,
+	}
+}
+
+// ServerConfigは、設定から決まるserver.Configの項目を埋めて返す
+// CommitLogやAuthorizerなどの実行時の依存は呼び出し側で設定する
+func (c *Config) ServerConfig() (*server.Config, error) {
+	authenticators, err := c.authenticators()
+	if err != nil {
+		return nil, err
+	}
+	sc := &server.Config{
+		TrustedForwarders: c.TrustedForwarders,
+		EnableReflection:  c.EnableReflection,
+		AckTimeout:        c.AckTimeout,
+		Authenticators:    authenticators,
+	}
+	if c.Quota.Default != (QuotaLimits{}) || len(c.Quota.Subjects) > 0 {
+		qc := server.QuotaConfig{
+			Default:  c.Quota.Default.limits(),
+			Subjects: make(map[string]server.QuotaLimits, len(c.Quota.Subjects)),
+		}
+		for subject, l := range c.Quota.Subjects {
+			qc.Subjects[subject] = l.limits()
+		}
+		sc.Quotas = server.NewQuotas(qc)
+	}
+	return sc, nil
+}
+
+// authenticatorsは、クライアント証明書、ベアラートークン、APIキーの順に試す認証を作成する
+func (c *Config) authenticators() ([]server.Authenticator, error) {
+	var mappings []server.SubjectMapping
+	if c.Auth.SPIFFETrustDomain != "" {
+		mappings = append(mappings, server.SPIFFEMapping(c.Auth.SPIFFETrustDomain))
+	}
+	for _, s := range c.Auth.Subjects {
+		source, err := server.ParseSubjectSource(s.Source)
+		if err != nil {
+			return nil, err
+		}
+		m := server.SubjectMapping{Source: source, Replacement: s.Replacement}
+		if s.Pattern != "" {
+			if m.Pattern, err = regexp.Compile(s.Pattern); err != nil {
+				return nil, err
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	authenticators := []server.Authenticator{server.TLSAuthenticator{Subjects: mappings}}
+
+	if c.Auth.JWKSFile != "" {
+		a, err := server.NewJWTAuthenticator(server.JWTConfig{
+			JWKSFile: c.Auth.JWKSFile,
+			Issuer:   c.Auth.JWTIssuer,
+			Audience: c.Auth.JWTAudience,
+		})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, a)
+	}
+	if len(c.Auth.APIKeys) > 0 {
+		authenticators = append(authenticators, server.NewAPIKeyAuthenticator(c.Auth.APIKeys))
+	}
+	return authenticators, nil
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "proglog.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+node_name: file
+bind_addr: 127.0.0.1:9401
+rpc_port: 9400
+start_join_addrs: [127.0.0.1:9501]
+segment:
+  max_store_bytes: 2048
+tls:
+  dir: /etc/proglog
+  ca_file: /etc/ssl/ca.pem
+auth:
+  api_keys:
+    secret: alice
+quota:
+  subjects:
+    alice:
+      produce_requests_per_second: 5
+ack_timeout: 3s
+`), 0600))
+
+	env := map[string]string{
+		"PROGLOG_CONFIG":                  file,
+		"PROGLOG_NODE_NAME":               "env",
+		"PROGLOG_SEGMENT_MAX_INDEX_BYTES": "4096",
+		"PROGLOG_TRUSTED_FORWARDERS":      "node-1, node-2",
+	}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	c, err := load([]string{"-node-name", "flag", "-rpc-port", "9410", "-enable-reflection"}, lookupEnv)
+	require.NoError(t, err)
+
+	// フラグ、環境変数、設定ファイル、既定値の順に優先する
+	require.Equal(t, "flag", c.NodeName)
+	require.Equal(t, "127.0.0.1:9410", c.RPCAddr())
+	require.Equal(t, []string{"node-1", "node-2"}, c.TrustedForwarders)
+	require.Equal(t, ":8080", c.HTTPAddr)
+	// boolのフラグは値を省略できる
+	require.True(t, c.EnableReflection)
+
+	lc := c.LogConfig()
+	require.Equal(t, uint64(2048), lc.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(4096), lc.Segment.MaxIndexBytes)
+
+	dc := c.DiscoveryConfig()
+	require.Equal(t, "flag", dc.NodeName)
+	require.Equal(t, "127.0.0.1:9401", dc.BindAddr)
+	require.Equal(t, "127.0.0.1:9410", dc.Tags["rpc_addr"])
+	require.Equal(t, []string{"127.0.0.1:9501"}, dc.StartJoinAddrs)
+
+	// 省略したファイルはtls.dirの下の既定の名前になる
+	tc := c.ServerTLSConfig()
+	require.Equal(t, "/etc/ssl/ca.pem", tc.CAFile)
+	require.Equal(t, "/etc/proglog/server.pem", tc.CertFile)
+	require.True(t, tc.Server)
+	require.Equal(t, "/etc/proglog/node-client.pem", c.PeerTLSConfig().CertFile)
+	require.Equal(t, "/etc/proglog/policy.csv", c.ACL.PolicyFile)
+
+	sc, err := c.ServerConfig()
+	require.NoError(t, err)
+	require.Equal(t, 3*time.Second, sc.AckTimeout)
+	require.Len(t, sc.Authenticators, 2)
+	require.NotNil(t, sc.Quotas)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	noEnv := func(string) (string, bool) { return "", false }
+
+	for name, test := range map[string]struct {
+		file string
+		args []string
+	}{
+		"unknown key":     {file: "rpc_prot: 1\n"},
+		"invalid type":    {file: "rpc_port: abc\n"},
+		"invalid flag":    {args: []string{"-rpc-port", "abc"}},
+		"extra arguments": {args: []string{"serve"}},
+		"invalid port":    {args: []string{"-rpc-port", "70000"}},
+		"invalid address": {args: []string{"-bind-addr", "localhost"}},
+		"issuer only":     {args: []string{"-auth-jwt-issuer", "me"}},
+		"invalid pair":    {args: []string{"-auth-api-keys", "secret"}},
+		"invalid bool":    {args: []string{"-enable-reflection=maybe"}},
+		"allowlist only":  {args: []string{"-allowed-nodes", "node-1"}},
+		"subject source":  {file: "auth:\n  subjects:\n    - source: email\n"},
+		"negative quota":  {args: []string{"-quota-default-produce-bytes-per-second", "-1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := test.args
+			if test.file != "" {
+				file := filepath.Join(dir, "proglog.yaml")
+				require.NoError(t, os.WriteFile(file, []byte(test.file), 0600))
+				args = append([]string{"-config", file}, args...)
+			}
+			_, err := load(args, noEnv)
+			require.Error(t, err)
+		})
+	}
+}
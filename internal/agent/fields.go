@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldは、環境変数とフラグで設定できるConfigの1つの項目
+type field struct {
+	// pathは、YAMLのキーの経路
+	path  []string
+	value reflect.Value
+	usage string
+}
+
+// fieldsは、Configの項目のうち、文字列から設定できるものを返す
+// 構造体のスライスなどは設定ファイルでのみ指定できる
+func (c *Config) fields() []field {
+	return collectFields(reflect.ValueOf(c).Elem(), nil)
+}
+
+func collectFields(v reflect.Value, prefix []string) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := append(append([]string(nil), prefix...), name)
+		fv := v.Field(i)
+		if sf.Type.Kind() == reflect.Struct && sf.Type != durationType {
+			fields = append(fields, collectFields(fv, path)...)
+			continue
+		}
+		if !settable(sf.Type) {
+			continue
+		}
+		fields = append(fields, field{path: path, value: fv, usage: sf.Tag.Get("usage")})
+	}
+	return fields
+}
+
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	stringsType   = reflect.TypeOf([]string(nil))
+	stringMapType = reflect.TypeOf(map[string]string(nil))
+)
+
+func settable(t reflect.Type) bool {
+	switch t {
+	case durationType, stringsType, stringMapType:
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int64, reflect.Uint64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// envNameは、tls.cert_fileならPROGLOG_TLS_CERT_FILEを返す
+func (f field) envName() string {
+	return envPrefix + strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+// flagNameは、tls.cert_fileならtls-cert-fileを返す
+func (f field) flagName() string {
+	return strings.ReplaceAll(strings.Join(f.path, "-"), "_", "-")
+}
+
+// argNameは、-hで値の型として表示する名前。flagパッケージの表記に合わせる
+func (f field) argName() string {
+	switch f.value.Type() {
+	case durationType:
+		return "duration"
+	case stringsType:
+		return "list"
+	case stringMapType:
+		return "key=value,..."
+	}
+	switch f.value.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int64:
+		return "int"
+	case reflect.Uint64:
+		return "uint"
+	case reflect.Float64:
+		return "float"
+	}
+	return ""
+}
+
+// setは、文字列を項目の型に変換して設定する
+// スライスはカンマ区切り、マップはカンマ区切りのkey=valueで指定する
+func (f field) set(s string) error {
+	v := f.value
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case stringsType:
+		v.Set(reflect.ValueOf(splitList(s)))
+		return nil
+	case stringMapType:
+		m := make(map[string]string)
+		for _, pair := range splitList(s) {
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid key=value pair %q", pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		v.Set(reflect.ValueOf(m))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// boolFuncは、値を省略できるフラグ。flag.BoolFuncと同じ働きをする
+type boolFunc func(string) error
+
+func (f boolFunc) Set(s string) error { return f(s) }
+func (f boolFunc) String() string     { return "" }
+func (f boolFunc) IsBoolFlag() bool   { return true }
+
+// printDefaultsは、flag.PrintDefaultsと同じ形式でフラグを表示する
+// flag.Funcで登録したフラグは型がvalueと表示されるため、argNamesの名前に置き換える
+func printDefaults(flags *flag.FlagSet, argNames map[string]string) {
+	flags.VisitAll(func(f *flag.Flag) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "  -%s", f.Name)
+		name, usage := flag.UnquoteUsage(f)
+		if n, ok := argNames[f.Name]; ok {
+			name = n
+		}
+		if name != "" {
+			b.WriteString(" " + name)
+		}
+		b.WriteString("\n    \t")
+		b.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+		fmt.Fprintln(flags.Output(), b.String())
+	})
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/discovery"
+	"github.com/tukki0210/proglog/internal/log"
+	"github.com/tukki0210/proglog/internal/server"
+)
+
+// replicationRetryIntervalは、リーダーからの複製が失敗してから再接続するまでの間隔
+var replicationRetryInterval = time.Second
+
+// leaderFinderは、生存しているメンバーのうち名前が最も小さいノードをリーダーとする
+// 合意による選出ではないため、メンバーシップの見え方がノードごとに異なる間は、
+// 複数のノードが自分をリーダーとみなして書き込みを受け付けることがある
+// そうして食い違ったログは、フォロワーが複製を始めるときにリーダーが検出して複製を拒否し、
+// フォロワーのレプリケーションのヘルスチェックは NOT_SERVING のままになる
+type leaderFinder struct {
+	membership *discovery.Membership
+	// nameは、このノード自身の名前
+	name string
+}
+
+var _ server.LeaderFinder = leaderFinder{}
+
+// membersは、RPCアドレスを公開している生存中のメンバーを返す
+func (f leaderFinder) members() []serf.Member {
+	var members []serf.Member
+	for _, member := range f.membership.Members() {
+		if member.Status == serf.StatusAlive && member.Tags["rpc_addr"] != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (f leaderFinder) leader() (serf.Member, bool) {
+	var leader serf.Member
+	found := false
+	for _, member := range f.members() {
+		if !found || member.Name < leader.Name {
+			leader = member
+			found = true
+		}
+	}
+	return leader, found
+}
+
+func (f leaderFinder) Leader() (string, bool, error) {
+	leader, ok := f.leader()
+	if !ok {
+		return "", false, errors.New("no alive members")
+	}
+	return leader.Tags["rpc_addr"], leader.Name == f.name, nil
+}
+
+// replicatorは、フォロワーでリーダーのログを複製して自分のログに追記する
+// リーダーが交代したら、新しいリーダーとログが一致することを確かめてから続きを複製する
+type replicator struct {
+	leaders  leaderFinder
+	log      *log.Log
+	health   *server.Health
+	dialOpts []grpc.DialOption
+	logger   *zap.Logger
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplicator(
+	leaders leaderFinder,
+	log *log.Log,
+	health *server.Health,
+	dialOpts []grpc.DialOption,
+) *replicator {
+	r := &replicator{
+		leaders:  leaders,
+		log:      log,
+		health:   health,
+		dialOpts: dialOpts,
+		logger:   zap.L().Named("replicator"),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// runは、メンバーシップが変わるたびにリーダーを探し直す
+func (r *replicator) run() {
+	defer close(r.stopped)
+	events, unsubscribe := r.leaders.membership.Subscribe()
+	defer unsubscribe()
+
+	var current string
+	stop := func() {}
+	defer func() { stop() }()
+	for {
+		addr, local, err := r.leaders.Leader()
+		switch {
+		case err != nil || local:
+			stop()
+			stop, current = func() {}, ""
+			// リーダーは複製するものがないので正常とする
+			r.health.SetHealthy(server.HealthReplication, err == nil)
+		case addr != current:
+			stop()
+			// 新しいリーダーの末尾に追いつくまでは正常としない
+			r.health.SetHealthy(server.HealthReplication, false)
+			stop, current = r.follow(addr), addr
+		}
+		select {
+		case <-events:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// followは、停止されるまでaddrのリーダーから複製を続ける
+func (r *replicator) follow(addr string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := r.replicate(ctx, addr)
+			r.health.SetHealthy(server.HealthReplication, false)
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Error("failed to replicate", zap.String("leader", addr), zap.Error(err))
+			// ログが食い違っているか、リーダーが切り詰めた範囲を必要とする場合は、
+			// 再接続しても追いつけないので、リーダーが交代するまで複製をやめる
+			switch status.Code(err) {
+			case codes.FailedPrecondition, codes.OutOfRange:
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(replicationRetryInterval):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// replicateは、リーダーのReplicationサービスから受け取ったレコードを追記し、
+// 追記するたびに次のオフセットをリーダーに伝える
+func (r *replicator) replicate(ctx context.Context, addr string) error {
+	conn, err := grpc.DialContext(ctx, addr, r.dialOpts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stream, err := api.NewReplicationClient(conn).Replicate(ctx)
+	if err != nil {
+		return err
+	}
+	next := r.log.NextOffset()
+	req := &api.ReplicateRequest{Node: r.leaders.name, NextOffset: next}
+	// リーダーが同じオフセットに同じレコードを持っているかを、最後のレコードで確かめてもらう
+	if next > 0 {
+		record, err := r.log.Read(next - 1)
+		if err != nil {
+			return err
+		}
+		if req.Checksum, err = server.RecordChecksum(record); err != nil {
+			return err
+		}
+	}
+	if err := stream.Send(req); err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		// レコードのない応答は、リーダーの末尾に追いついたことを示す
+		if res.Record == nil {
+			r.health.SetHealthy(server.HealthReplication, true)
+			continue
+		}
+		if next := r.log.NextOffset(); res.Record.Offset != next {
+			return status.Errorf(
+				codes.FailedPrecondition,
+				"leader sent record %d but the next offset is %d",
+				res.Record.Offset,
+				next,
+			)
+		}
+		if _, err := r.log.Append(res.Record); err != nil {
+			return err
+		}
+		if err := stream.Send(&api.ReplicateRequest{NextOffset: r.log.NextOffset()}); err != nil {
+			return err
+		}
+	}
+}
+
+// Closeは、複製を止めてリーダーへの接続を閉じる
+func (r *replicator) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+	<-r.stopped
+}
+
+// replicationWaiterは、リーダーで生存している全てのフォロワーがレコードを複製するまで待つ
+// フォロワーはReplicationサービスで追記したオフセットを伝えてくる
+type replicationWaiter struct {
+	leaders  leaderFinder
+	replicas *server.Replicas
+}
+
+var _ server.ReplicationWaiter = replicationWaiter{}
+
+func (w replicationWaiter) WaitReplicated(ctx context.Context, offset uint64) error {
+	for _, member := range w.leaders.members() {
+		if member.Name == w.leaders.name {
+			continue
+		}
+		if err := w.replicas.Wait(ctx, member.Name, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
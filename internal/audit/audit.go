@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/log"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Configは、監査ログの設定
+type Config struct {
+	// Logは、監査ログを書き込むコミットログの設定
+	Log log.Config
+	// MaxBytesを超えた場合、古いセグメントから削除する。0の場合は全て残す
+	// 書き込み中のセグメントは削除しないので、最大でセグメント1つ分超えることがある
+	MaxBytes uint64
+}
+
+// Logは、認可の判断を専用のコミットログに記録する
+// イベントは時刻の順に追加するので、時刻の範囲を二分探索で探せる
+type Log struct {
+	// Recordが古いセグメントを削除している間は、Queryで読まないようにする
+	mu       sync.RWMutex
+	log      *log.Log
+	maxBytes uint64
+	last     time.Time
+	now      func() time.Time
+}
+
+// Newは、dirのコミットログに監査ログを作成する
+func New(dir string, c Config) (*Log, error) {
+	l, err := log.NewLog(dir, c.Log)
+	if err != nil {
+		return nil, err
+	}
+	a := &Log{
+		log:      l,
+		maxBytes: c.MaxBytes,
+		now:      time.Now,
+	}
+	// 再起動した場合も時刻の順序を保つため、最後のイベントの時刻から再開する
+	if last, ok, err := a.lastEvent(); err != nil {
+		return nil, err
+	} else if ok {
+		a.last = last.Time.AsTime()
+	}
+	return a, nil
+}
+
+// Recordは、イベントに時刻を付けて監査ログに追加する
+func (a *Log) Record(e *api.AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// 時計が戻っても、時刻が前のイベントより前にならないようにする
+	now := a.now()
+	if now.Before(a.last) {
+		now = a.last
+	}
+	a.last = now
+	e.Time = timestamppb.New(now)
+
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = a.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	return a.truncate()
+}
+
+// truncateは、監査ログがMaxBytesを超えている場合に、古いセグメントから削除する
+func (a *Log) truncate() error {
+	if a.maxBytes == 0 {
+		return nil
+	}
+	segments := a.log.Segments()
+	var total uint64
+	for _, s := range segments {
+		total += s.StoreBytes + s.IndexBytes
+	}
+	// 最後のセグメントは書き込み中なので残す
+	var highest uint64
+	removed := false
+	for _, s := range segments[:len(segments)-1] {
+		if total <= a.maxBytes {
+			break
+		}
+		total -= s.StoreBytes + s.IndexBytes
+		highest = s.NextOffset - 1
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return a.log.Truncate(highest)
+}
+
+// Queryは、startからendまでのsubjectのイベントを古い順に最大limit件返す
+// startとendがゼロ値の場合は範囲を制限せず、subjectが空の場合は全てのsubjectを返す
+func (a *Log) Query(start, end time.Time, subject string, limit int) ([]*api.AuditEvent, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	lowest, highest, ok, err := a.offsets()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// startより前のイベントを読み飛ばす
+	var readErr error
+	n := sort.Search(int(highest-lowest+1), func(i int) bool {
+		e, err := a.read(lowest + uint64(i))
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return !e.Time.AsTime().Before(start)
+	})
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var events []*api.AuditEvent
+	for off := lowest + uint64(n); off <= highest; off++ {
+		e, err := a.read(off)
+		if err != nil {
+			return nil, err
+		}
+		if !end.IsZero() && e.Time.AsTime().After(end) {
+			break
+		}
+		if subject != "" && e.Subject != subject {
+			continue
+		}
+		events = append(events, e)
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (a *Log) Close() error {
+	return a.log.Close()
+}
+
+// offsetsは、監査ログのオフセットの範囲を返す。イベントがない場合はfalseを返す
+func (a *Log) offsets() (lowest, highest uint64, ok bool, err error) {
+	if lowest, err = a.log.LowestOffset(); err != nil {
+		return 0, 0, false, err
+	}
+	if highest, err = a.log.HighestOffset(); err != nil {
+		return 0, 0, false, err
+	}
+	// 空のログでもHighestOffsetは0を返すので、読めるかどうかで確認する
+	if _, err := a.log.Read(highest); err != nil {
+		return 0, 0, false, nil
+	}
+	return lowest, highest, true, nil
+}
+
+func (a *Log) lastEvent() (*api.AuditEvent, bool, error) {
+	_, highest, ok, err := a.offsets()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	e, err := a.read(highest)
+	return e, err == nil, err
+}
+
+func (a *Log) read(off uint64) (*api.AuditEvent, error) {
+	record, err := a.log.Read(off)
+	if err != nil {
+		return nil, err
+	}
+	e := &api.AuditEvent{}
+	if err := proto.Unmarshal(record.Value, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Log.Segment.MaxStoreBytes = 128
+	a, err := New(dir, c)
+	require.NoError(t, err)
+
+	events, err := a.Query(time.Time{}, time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	base := time.Unix(1000, 0).UTC()
+	now := base
+	a.now = func() time.Time { return now }
+	for i, subject := range []string{"root", "nobody", "root", "root", "nobody"} {
+		now = base.Add(time.Duration(i) * time.Second)
+		require.NoError(t, a.Record(&api.AuditEvent{
+			Subject: subject,
+			Action:  "produce",
+			Object:  "*",
+			Allowed: subject == "root",
+		}))
+	}
+	// 時計が戻っても時刻の順序を保つ
+	now = base
+	require.NoError(t, a.Record(&api.AuditEvent{Subject: "root"}))
+
+	events, err = a.Query(time.Time{}, time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 6, len(events))
+	require.Equal(t, base.Add(4*time.Second), events[5].Time.AsTime())
+
+	events, err = a.Query(base.Add(time.Second), base.Add(3*time.Second), "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(events))
+	require.Equal(t, "nobody", events[0].Subject)
+
+	events, err = a.Query(base.Add(time.Second), time.Time{}, "nobody", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(events))
+	for _, e := range events {
+		require.False(t, e.Allowed)
+	}
+
+	events, err = a.Query(time.Time{}, time.Time{}, "root", 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(events))
+	require.Equal(t, base.Add(2*time.Second), events[1].Time.AsTime())
+
+	require.NoError(t, a.Close())
+
+	// 再起動後も、最後のイベントより前の時刻にはならない
+	a, err = New(dir, c)
+	require.NoError(t, err)
+	a.now = func() time.Time { return base }
+	require.NoError(t, a.Record(&api.AuditEvent{Subject: "root"}))
+	events, err = a.Query(base.Add(4*time.Second), time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(events))
+	require.NoError(t, a.Close())
+}
+
+func TestLogRetention(t *testing.T) {
+	dir, err := os.MkdirTemp("", "audit-retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{MaxBytes: 512}
+	c.Log.Segment.MaxStoreBytes = 128
+	a, err := New(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, a.Record(&api.AuditEvent{Subject: "root"}))
+	}
+
+	// MaxBytesを超えないように、古いセグメントから削除している
+	var total uint64
+	for _, s := range a.log.Segments() {
+		total += s.StoreBytes + s.IndexBytes
+	}
+	require.LessOrEqual(t, total, c.MaxBytes)
+	lowest, err := a.log.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+
+	events, err := a.Query(time.Time{}, time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 50-int(lowest), len(events))
+
+	// 残りのイベントは、再び開いても読める
+	require.NoError(t, a.Close())
+	a, err = New(dir, c)
+	require.NoError(t, err)
+	events, err = a.Query(time.Time{}, time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 50-int(lowest), len(events))
+	require.NoError(t, a.Close())
+}
+
+func TestLogQueryDuringRetention(t *testing.T) {
+	c := Config{MaxBytes: 512}
+	c.Log.Segment.MaxStoreBytes = 128
+	a, err := New(t.TempDir(), c)
+	require.NoError(t, err)
+	defer a.Close()
+
+	// 古いセグメントを削除している間も、Queryは残っているイベントを読める
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			if err := a.Record(&api.AuditEvent{Subject: "root"}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			return
+		default:
+		}
+		_, err := a.Query(time.Time{}, time.Time{}, "", 0)
+		require.NoError(t, err)
+	}
+}
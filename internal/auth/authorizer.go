@@ -2,27 +2,48 @@ package auth
 
 import (
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/casbin/casbin"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 
 type Authorizer struct {
-	enforcer *casbin.Enforcer
+	model  string
+	policy string
+	// seedは、NewPersistentで作成した場合の設定のポリシーのファイル
+	seed string
+	// Reloadで差し替えるため、認可中のゴルーチンとはアトミックに共有する
+	enforcer atomic.Pointer[casbin.Enforcer]
+	// Reloadを直列化する
+	mu     sync.Mutex
+	logger *zap.Logger
 }
 
 // New関数は、AuthorizerのFactory関数
 func New(model, policy string) *Authorizer {
 	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{
-		enforcer: enforcer,
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		logger: newLogger(),
 	}
+	a.enforcer.Store(enforcer)
+	return a
+}
+
+func newLogger() *zap.Logger {
+	return zap.L().Named("authorizer")
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	if !a.enforcer.Load().Enforce(subject, object, action) {
 		msg := fmt.Sprintf(
 			"%s not permitted to %s to %s",
 			subject,
@@ -35,3 +56,110 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 	return nil
 }
 
+// Reloadは、モデルとポリシーのファイルを読み直して差し替える
+// NewPersistentで作成した場合は、設定のポリシーのファイルの変更を取り込んでから読み直す
+// 読み込みに失敗した場合は、エラーを返して以前のポリシーを使い続ける
+func (a *Authorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.seed != "" {
+		if err := a.mergeSeed(); err != nil {
+			return err
+		}
+	}
+	enforcer, err := a.load()
+	if err != nil {
+		return err
+	}
+	a.enforcer.Store(enforcer)
+	return nil
+}
+
+// loadは、ファイルから新しいenforcerを作成して検証する
+func (a *Authorizer) load() (*casbin.Enforcer, error) {
+	return a.loadFile(a.policy)
+}
+
+// loadFileは、policyのファイルから新しいenforcerを作成して検証する
+func (a *Authorizer) loadFile(policy string) (*casbin.Enforcer, error) {
+	enforcer, err := casbin.NewEnforcerSafe(a.model, policy)
+	if err == nil {
+		err = validate(enforcer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load acl from %s and %s: %w", a.model, policy, err)
+	}
+	return enforcer, nil
+}
+
+// validateは、全てのポリシーがモデルの定義と同じ数の値を持つことを確認する
+// casbinは読み込み時に確認せず、認可のときにパニックするため
+func validate(enforcer *casbin.Enforcer) error {
+	def, ok := enforcer.GetModel()["p"]["p"]
+	if !ok {
+		return fmt.Errorf("model has no policy definition")
+	}
+	for _, rule := range enforcer.GetPolicy() {
+		if len(rule) != len(def.Tokens) {
+			return fmt.Errorf("policy %v does not match definition %s", rule, def.Value)
+		}
+	}
+	return nil
+}
+
+// Watchは、モデルとポリシーのファイルをintervalごとに確認し、変更されたらReloadする
+// NewPersistentで作成した場合は、データディレクトリではなく設定のポリシーのファイルを確認する
+// 返り値の関数で監視を止める
+func (a *Authorizer) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	last := a.fileStamp()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			stamp := a.fileStamp()
+			if stamp == last {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				a.logger.Error("failed to reload acl", zap.Error(err))
+			} else {
+				a.logger.Info("reloaded acl")
+			}
+			// 失敗した場合も、同じ内容で何度も読み直さないように記録する
+			last = stamp
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// fileStampは、ファイルの変更を検出するための更新時刻とサイズ
+type fileStamp [2]struct {
+	modTime time.Time
+	size    int64
+}
+
+func (a *Authorizer) fileStamp() fileStamp {
+	var stamp fileStamp
+	policy := a.policy
+	if a.seed != "" {
+		policy = a.seed
+	}
+	for i, name := range []string{a.model, policy} {
+		if fi, err := os.Stat(name); err == nil {
+			stamp[i].modTime = fi.ModTime()
+			stamp[i].size = fi.Size()
+		}
+	}
+	return stamp
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const model = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && keyMatch(r.obj, p.obj) && r.act == p.act
+`
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	policyFile := filepath.Join(dir, "policy.csv")
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(name, []byte(content), 0600))
+	}
+	write(modelFile, model)
+	write(policyFile, "p, root, *, produce\n")
+
+	a := New(modelFile, policyFile)
+	require.NoError(t, a.Authorize("root", "orders", "produce"))
+	err := a.Authorize("root", "orders", "consume")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	write(policyFile, "p, root, *, produce\np, root, *, consume\n")
+	require.NoError(t, a.Reload())
+	require.NoError(t, a.Authorize("root", "orders", "consume"))
+
+	// 読み込めない場合は以前のポリシーを使い続ける
+	for _, policy := range []string{
+		"p, root, *\n",
+		"x, root, *, produce\n",
+	} {
+		write(policyFile, policy)
+		require.Error(t, a.Reload(), policy)
+		require.NoError(t, a.Authorize("root", "orders", "consume"))
+	}
+	write(modelFile, "[matchers]\n")
+	require.Error(t, a.Reload())
+	require.NoError(t, a.Authorize("root", "orders", "consume"))
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(modelFile, []byte(model), 0600))
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, *, produce\n"), 0600))
+
+	a := New(modelFile, policyFile)
+	stop := a.Watch(10 * time.Millisecond)
+	defer stop()
+
+	require.NoError(t, os.WriteFile(policyFile, []byte(""), 0600))
+	require.Eventually(t, func() bool {
+		return a.Authorize("root", "orders", "produce") != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPersistentRejectsInvalidPolicy(t *testing.T) {
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	seedFile := filepath.Join(dir, "seed.csv")
+	require.NoError(t, os.WriteFile(modelFile, []byte(model), 0600))
+	require.NoError(t, os.WriteFile(seedFile, []byte("p, root, *, produce\n"), 0600))
+	a, err := NewPersistent(modelFile, seedFile, t.TempDir())
+	require.NoError(t, err)
+
+	// 区切りや改行を含むルールは、policy.csvに他のルールを書き込めてしまう
+	for _, subject := range []string{"a,b", `"a"`, "a\np, nobody, *, produce", ""} {
+		_, err := a.AddPolicy(subject, "*", "produce")
+		require.Error(t, err, subject)
+		_, err = a.RemovePolicy(subject, "*", "produce")
+		require.Error(t, err, subject)
+	}
+	require.Equal(t, [][]string{{"root", "*", "produce"}}, a.Policies())
+	require.NoError(t, a.Reload())
+}
+
+func TestPersistentMergesSeed(t *testing.T) {
+	dir := t.TempDir()
+	modelFile := filepath.Join(dir, "model.conf")
+	seedFile := filepath.Join(dir, "seed.csv")
+	dataDir := t.TempDir()
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(seedFile, []byte(content), 0600))
+	}
+	require.NoError(t, os.WriteFile(modelFile, []byte(model), 0600))
+	write("p, root, *, produce\np, root, *, consume\n")
+	a, err := NewPersistent(modelFile, seedFile, dataDir)
+	require.NoError(t, err)
+	_, err = a.AddPolicy("admin", "*", "produce")
+	require.NoError(t, err)
+
+	// 設定のファイルで追加・削除したルールを反映し、Adminサービスで追加したルールは残す
+	write("p, root, *, produce\np, nobody, *, consume\n")
+	require.NoError(t, a.Reload())
+	require.ElementsMatch(t, [][]string{
+		{"root", "*", "produce"},
+		{"admin", "*", "produce"},
+		{"nobody", "*", "consume"},
+	}, a.Policies())
+
+	// 停止中に編集した場合も、次に起動したときに反映する
+	write("p, root, *, produce\n")
+	a, err = NewPersistent(modelFile, seedFile, dataDir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][]string{
+		{"root", "*", "produce"},
+		{"admin", "*", "produce"},
+	}, a.Policies())
+
+	// 読み込めない場合は以前のポリシーを使い続ける
+	write("p, root, *\n")
+	require.Error(t, a.Reload())
+	require.NoError(t, a.Authorize("admin", "orders", "produce"))
+}
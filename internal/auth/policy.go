@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/casbin/casbin"
+)
+
+// PolicyFileは、NewPersistentがデータディレクトリに保存するポリシーのファイル名
+const PolicyFile = "policy.csv"
+
+// AppliedSeedFileは、最後に取り込んだ設定のポリシーのファイルの写し
+// 次に読み直したときに、設定のファイルで追加・削除されたルールを求めるために使う
+const AppliedSeedFile = "seed.csv"
+
+// NewPersistentは、ポリシーをデータディレクトリに保存するAuthorizerを作成する
+// データディレクトリにポリシーがない場合は、seedPolicyの内容で初期化する
+// その後seedPolicyで追加・削除されたルールは、起動時とReloadでデータディレクトリの
+// ポリシーに反映する。Adminサービスで変更したルールはそのまま残る
+func NewPersistent(model, seedPolicy, dir string) (*Authorizer, error) {
+	policy := filepath.Join(dir, PolicyFile)
+	if _, err := os.Stat(policy); os.IsNotExist(err) {
+		if err := copyFile(seedPolicy, policy); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		seed:   seedPolicy,
+		logger: newLogger(),
+	}
+	if err := a.mergeSeed(); err != nil {
+		return nil, err
+	}
+	enforcer, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	a.enforcer.Store(enforcer)
+	return a, nil
+}
+
+// mergeSeedは、前回取り込んでから設定のポリシーのファイルで追加・削除されたルールを、
+// データディレクトリのポリシーに反映する。a.muのロックを取るか、公開する前に呼ぶ
+func (a *Authorizer) mergeSeed() error {
+	next, err := a.loadFile(a.seed)
+	if err != nil {
+		return err
+	}
+	applied := filepath.Join(filepath.Dir(a.policy), AppliedSeedFile)
+	if _, err := os.Stat(applied); os.IsNotExist(err) {
+		// 写しを残していなかったデータディレクトリでは、今の設定のファイルを取り込み済みとする
+		return savePolicy(applied, next)
+	} else if err != nil {
+		return err
+	}
+	prev, err := a.loadFile(applied)
+	if err != nil {
+		return err
+	}
+	enforcer, err := a.load()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, rule := range subtractPolicy(next.GetPolicy(), prev.GetPolicy()) {
+		changed = enforcer.AddPolicy(rule) || changed
+	}
+	for _, rule := range subtractPolicy(prev.GetPolicy(), next.GetPolicy()) {
+		changed = enforcer.RemovePolicy(rule) || changed
+	}
+	if changed {
+		if err := savePolicy(a.policy, enforcer); err != nil {
+			return err
+		}
+	}
+	return savePolicy(applied, next)
+}
+
+// subtractPolicyは、rulesのうちotherにないルールを返す
+func subtractPolicy(rules, other [][]string) [][]string {
+	seen := make(map[string]bool, len(other))
+	for _, rule := range other {
+		seen[strings.Join(rule, ",")] = true
+	}
+	var diff [][]string
+	for _, rule := range rules {
+		if !seen[strings.Join(rule, ",")] {
+			diff = append(diff, rule)
+		}
+	}
+	return diff
+}
+
+// invalidPolicyCharsは、policy.csvの区切りや行を壊すため、ルールに使えない文字
+const invalidPolicyChars = ",\"\r\n"
+
+// validatePolicyは、ルールをpolicy.csvに保存しても他のルールを壊さないかを確かめる
+func validatePolicy(rule ...string) error {
+	for _, field := range rule {
+		if field == "" || strings.ContainsAny(field, invalidPolicyChars) {
+			return fmt.Errorf("invalid policy field %q", field)
+		}
+	}
+	return nil
+}
+
+// AddPolicyは、ポリシーを追加してファイルに保存する
+// 既に同じポリシーがある場合はfalseを返す
+func (a *Authorizer) AddPolicy(subject, object, action string) (bool, error) {
+	if err := validatePolicy(subject, object, action); err != nil {
+		return false, err
+	}
+	return a.update(func(e *casbin.Enforcer) bool {
+		return e.AddPolicy(subject, object, action)
+	})
+}
+
+// RemovePolicyは、ポリシーを削除してファイルに保存する
+// 該当するポリシーがない場合はfalseを返す
+func (a *Authorizer) RemovePolicy(subject, object, action string) (bool, error) {
+	if err := validatePolicy(subject, object, action); err != nil {
+		return false, err
+	}
+	return a.update(func(e *casbin.Enforcer) bool {
+		return e.RemovePolicy(subject, object, action)
+	})
+}
+
+// Policiesは、現在のポリシーを[subject, object, action]の一覧で返す
+func (a *Authorizer) Policies() [][]string {
+	return a.enforcer.Load().GetPolicy()
+}
+
+// updateは、ファイルから読み込んだenforcerを変更して保存してから差し替える
+// 認可中のenforcerは変更しないので、Authorizeとロックを共有しなくてよい
+func (a *Authorizer) update(fn func(*casbin.Enforcer) bool) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	enforcer, err := a.load()
+	if err != nil {
+		return false, err
+	}
+	if !fn(enforcer) {
+		return false, nil
+	}
+	if err := savePolicy(a.policy, enforcer); err != nil {
+		return false, err
+	}
+	a.enforcer.Store(enforcer)
+	return true, nil
+}
+
+// savePolicyは、途中で失敗しても元のファイルが壊れないように、
+// 一時ファイルに書き込んでから置き換える
+func savePolicy(name string, enforcer *casbin.Enforcer) error {
+	var b strings.Builder
+	for _, rule := range enforcer.GetPolicy() {
+		fmt.Fprintf(&b, "p, %s\n", strings.Join(rule, ", "))
+	}
+	// モデルにロールの定義がない場合、GetGroupingPolicyはパニックする
+	if _, ok := enforcer.GetModel()["g"]["g"]; ok {
+		for _, rule := range enforcer.GetGroupingPolicy() {
+			fmt.Fprintf(&b, "g, %s\n", strings.Join(rule, ", "))
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// NodeOUは、クラスタのノードに発行するクライアント証明書のOU
+// このOUの証明書で接続したノードだけが、転送元のクライアントのsubjectを引き継げる
+const NodeOU = "proglog-node"
+
+// KeyPairは、証明書とその秘密鍵
+type KeyPair struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// CertRequestは、CAで発行する証明書の内容
+type CertRequest struct {
+	CommonName string
+	// Hostsは、SANに入れるDNS名、IPアドレス、URI
+	Hosts    []string
+	Validity time.Duration
+	// Serverがtrueの場合はサーバー認証用、falseの場合はクライアント認証用の証明書を発行する
+	Server bool
+	// OrganizationalUnitsは、サブジェクトのOU。ノードの証明書にはNodeOUを入れる
+	OrganizationalUnits []string
+}
+
+// NewCAは、自己署名したCAの証明書と鍵を作成する
+func NewCA(commonName string, validity time.Duration) (*KeyPair, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := newTemplate(commonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	return sign(tmpl, tmpl, key, key)
+}
+
+// Issueは、CAのKeyPairで署名した証明書と鍵を作成する
+func (ca *KeyPair) Issue(req CertRequest) (*KeyPair, error) {
+	if !ca.Cert.IsCA {
+		return nil, fmt.Errorf("%q is not a ca", ca.Cert.Subject.CommonName)
+	}
+	if req.CommonName == "" {
+		return nil, errors.New("missing common name")
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := newTemplate(req.CommonName, req.Validity)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Subject.OrganizationalUnit = req.OrganizationalUnits
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	if req.Server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, h := range req.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if u, err := url.Parse(h); err == nil && u.Scheme != "" && u.Host != "" {
+			tmpl.URIs = append(tmpl.URIs, u)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return sign(tmpl, ca.Cert, key, ca.Key)
+}
+
+func newKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	if validity <= 0 {
+		return nil, fmt.Errorf("invalid validity %s", validity)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	// 時計のずれがあっても、発行した直後から使えるようにする
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func sign(tmpl, parent *x509.Certificate, key, parentKey crypto.Signer) (*KeyPair, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+// LoadKeyPairは、PEM形式の証明書と鍵のファイルを読み込む
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", keyFile)
+	}
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+// WriteFilesは、証明書と鍵をPEM形式でファイルに書き込む。鍵は所有者だけが読める
+func (p *KeyPair) WriteFiles(certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(p.Key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", p.Cert.Raw, 0644)
+}
+
+// writePEMは、permでファイルに書き込む。os.WriteFileは既存のファイルの
+// パーミッションを変えないため、鍵を書き込む前にpermにする
+func writePEM(name, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("test ca", time.Hour)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	server, err := ca.Issue(CertRequest{
+		CommonName: "server",
+		Hosts:      []string{"localhost", "127.0.0.1", "spiffe://example.org/server"},
+		Validity:   time.Hour,
+		Server:     true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"localhost"}, server.Cert.DNSNames)
+	require.Len(t, server.Cert.IPAddresses, 1)
+	require.Equal(t, "spiffe://example.org/server", server.Cert.URIs[0].String())
+	_, err = server.Cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   "127.0.0.1",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	require.NoError(t, err)
+
+	node, err := ca.Issue(CertRequest{
+		CommonName:          "node",
+		Validity:            time.Hour,
+		OrganizationalUnits: []string{NodeOU},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{NodeOU}, node.Cert.Subject.OrganizationalUnit)
+
+	client, err := ca.Issue(CertRequest{CommonName: "root", Validity: time.Hour})
+	require.NoError(t, err)
+	opts := x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	_, err = client.Cert.Verify(opts)
+	require.NoError(t, err)
+	// クライアント証明書はサーバー認証に使えない
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	_, err = client.Cert.Verify(opts)
+	require.Error(t, err)
+
+	// CAではない証明書では発行できない
+	_, err = client.Issue(CertRequest{CommonName: "x", Validity: time.Hour})
+	require.Error(t, err)
+	_, err = ca.Issue(CertRequest{CommonName: "x"})
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "root-client.pem")
+	keyFile := filepath.Join(dir, "root-client-key.pem")
+	// 既存の鍵のファイルが誰でも読めても、所有者だけが読めるようにして書き込む
+	require.NoError(t, os.WriteFile(keyFile, nil, 0644))
+	require.NoError(t, client.WriteFiles(certFile, keyFile))
+	info, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	loaded, err := LoadKeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	require.Equal(t, client.Cert.Raw, loaded.Cert.Raw)
+	require.Equal(t, client.Key.Public(), loaded.Key.Public())
+}
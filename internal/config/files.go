@@ -7,24 +7,32 @@ import (
 
 var (
 	CAFile = configFile("ca.pem")
+	CAKeyFile = configFile("ca-key.pem")
 	ServerCertFile = configFile("server.pem")
 	ServerKeyFile = configFile("server-key.pem")
 	RootClientCertFile = configFile("root-client.pem")
 	RootClientKeyFile = configFile("root-client-key.pem")
 	NobodyClientCertFile = configFile("nobody-client.pem")
 	NobodyClientKeyFile = configFile("nobody-client-key.pem")
+	NodeClientCertFile = configFile("node-client.pem")
+	NodeClientKeyFile = configFile("node-client-key.pem")
 	ACLModelFile = configFile("model.conf")
 	ACLPolicyFile = configFile("policy.csv")
 )
 
 func configFile(filename string) string {
+	return filepath.Join(Dir(), filename)
+}
+
+// Dirは、設定ファイルを置くディレクトリ。CONFIG_DIRか$HOME/.proglogを使う
+func Dir() string {
 	if dir := os.Getenv("CONFIG_DIR"); dir != "" {
-		return filepath.Join(dir, filename)
+		return dir
 	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
 	}
-	return filepath.Join(homeDir, ".proglog", filename)
+	return filepath.Join(homeDir, ".proglog")
 }
 
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertReloaderは、証明書と鍵、CAのファイルを読み直し、TLSのハンドシェイクごとに
+// 最新のものを使う。再起動せずに証明書をローテーションするために使う
+type CertReloader struct {
+	cfg TLSConfig
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	ca   *x509.CertPool
+
+	logger *zap.Logger
+}
+
+// NewCertReloaderは、ファイルを読み込んでCertReloaderを作成する
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	r := &CertReloader{
+		cfg:    cfg,
+		logger: zap.L().Named("tls"),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reloadは、ファイルを読み直して差し替える
+// 読み込みに失敗した場合は、エラーを返して以前の証明書を使い続ける
+func (r *CertReloader) Reload() error {
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" && r.cfg.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var ca *x509.CertPool
+	if r.cfg.CAFile != "" {
+		var err error
+		if ca, err = loadCertPool(r.cfg.CAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	r.ca = ca
+	return nil
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("failed to parse root certificate: %q", name)
+	}
+	return ca, nil
+}
+
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.ca
+}
+
+// GetCertificateは、サーバーとして最新の証明書を返す
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		return nil, errors.New("no certificate configured")
+	}
+	return cert, nil
+}
+
+// GetClientCertificateは、クライアントとして最新の証明書を返す
+// 証明書がない場合は、証明書を送らずにハンドシェイクを続ける
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
+
+// TLSConfigは、SetupTLSConfigと同じ設定で、証明書とCAをハンドシェイクごとに
+// 読み直した最新のものにするtls.Configを返す
+func (r *CertReloader) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: r.cfg.ServerAddress,
+	}
+	if r.cfg.Server {
+		// gRPCとHTTPのサーバーが設定に加えるALPNは、ハンドシェイクごとの設定には
+		// 引き継がれないので、あらかじめ両方を設定しておく
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		// ClientCAsは差し替えられないので、ハンドシェイクごとに設定を作り直す
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, ca := r.current()
+			c := &tls.Config{
+				MinVersion:     tls.VersionTLS13,
+				GetCertificate: r.GetCertificate,
+				NextProtos:     tlsConfig.NextProtos,
+			}
+			if ca != nil {
+				c.ClientCAs = ca
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		}
+		tlsConfig.GetCertificate = r.GetCertificate
+		return tlsConfig
+	}
+
+	tlsConfig.GetClientCertificate = r.GetClientCertificate
+	if r.cfg.CAFile != "" {
+		// RootCAsは差し替えられないので、標準の検証の代わりに最新のCAで検証する
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyServer
+	}
+	return tlsConfig
+}
+
+// verifyServerは、InsecureSkipVerifyで省いた標準の検証と同じく、
+// サーバーの証明書チェーンとホスト名を最新のCAで検証する
+func (r *CertReloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	_, ca := r.current()
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// Watchは、ファイルをintervalごとに確認し、変更されたらReloadする
+// 返り値の関数で監視を止める
+func (r *CertReloader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	last := r.fileStamp()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			stamp := r.fileStamp()
+			if stamp == last {
+				continue
+			}
+			// 証明書と鍵を別々に書き換えている途中は失敗するが、
+			// 両方を書き換えると再び変更を検出して読み直す
+			if err := r.Reload(); err != nil {
+				r.logger.Error("failed to reload certificates", zap.Error(err))
+			} else {
+				r.logger.Info("reloaded certificates")
+			}
+			last = stamp
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// fileStampは、ファイルの変更を検出するための更新時刻とサイズ
+type fileStamp [3]struct {
+	modTime time.Time
+	size    int64
+}
+
+func (r *CertReloader) fileStamp() fileStamp {
+	var stamp fileStamp
+	for i, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			stamp[i].modTime = fi.ModTime()
+			stamp[i].size = fi.Size()
+		}
+	}
+	return stamp
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	files := func(name string) TLSConfig {
+		return TLSConfig{
+			CertFile: filepath.Join(dir, name+".pem"),
+			KeyFile:  filepath.Join(dir, name+"-key.pem"),
+			CAFile:   filepath.Join(dir, "ca.pem"),
+		}
+	}
+	serverFiles, clientFiles := files("server"), files("client")
+
+	ca := newTestCA(t)
+	ca.write(t, serverFiles.CAFile)
+	serial := ca.issue(t, serverFiles, true)
+	ca.issue(t, clientFiles, false)
+
+	serverFiles.Server = true
+	server, err := NewCertReloader(serverFiles)
+	require.NoError(t, err)
+	clientFiles.ServerAddress = "127.0.0.1"
+	client, err := NewCertReloader(clientFiles)
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig())
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	handshake := func() (*big.Int, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), client.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber, nil
+	}
+
+	got, err := handshake()
+	require.NoError(t, err)
+	require.Equal(t, serial, got)
+
+	// 同じCAで証明書を更新する
+	serial = ca.issue(t, serverFiles, true)
+	require.NoError(t, server.Reload())
+	got, err = handshake()
+	require.NoError(t, err)
+	require.Equal(t, serial, got)
+
+	// 読み込めない場合は以前の証明書を使い続ける
+	require.NoError(t, os.WriteFile(serverFiles.KeyFile, []byte("broken"), 0600))
+	require.Error(t, server.Reload())
+	got, err = handshake()
+	require.NoError(t, err)
+	require.Equal(t, serial, got)
+
+	// CAを入れ替えると、読み直すまでは新しい証明書を検証できない
+	ca = newTestCA(t)
+	ca.write(t, serverFiles.CAFile)
+	serial = ca.issue(t, serverFiles, true)
+	ca.issue(t, clientFiles, false)
+	require.NoError(t, server.Reload())
+	_, err = handshake()
+	require.Error(t, err)
+
+	require.NoError(t, client.Reload())
+	got, err = handshake()
+	require.NoError(t, err)
+	require.Equal(t, serial, got)
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	cfg := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	}
+	ca := newTestCA(t)
+	ca.write(t, cfg.CAFile)
+	ca.issue(t, cfg, true)
+
+	r, err := NewCertReloader(cfg)
+	require.NoError(t, err)
+	stop := r.Watch(10 * time.Millisecond)
+	defer stop()
+
+	serial := ca.issue(t, cfg, true)
+	require.Eventually(t, func() bool {
+		cert, err := r.GetCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.SerialNumber.Cmp(serial) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca, err := NewCA("test ca", time.Hour)
+	require.NoError(t, err)
+	return &testCA{ca}
+}
+
+type testCA struct{ *KeyPair }
+
+func (ca *testCA) write(t *testing.T, name string) {
+	t.Helper()
+	require.NoError(t, writePEM(name, "CERTIFICATE", ca.Cert.Raw, 0644))
+}
+
+// issueは、CAで署名した証明書と鍵をcfgのファイルに書き込み、シリアル番号を返す
+func (ca *testCA) issue(t *testing.T, cfg TLSConfig, server bool) *big.Int {
+	t.Helper()
+	pair, err := ca.Issue(CertRequest{
+		CommonName: "root",
+		Hosts:      []string{"127.0.0.1"},
+		Validity:   time.Hour,
+		Server:     server,
+	})
+	require.NoError(t, err)
+	require.NoError(t, pair.WriteFiles(cfg.CertFile, cfg.KeyFile))
+	return pair.Cert.SerialNumber
+}
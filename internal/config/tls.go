@@ -2,9 +2,7 @@ package config
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"os"
+	"time"
 )
 
 // CSRファイル：自分の公開鍵に、コモンネームなどの方法を記述したファイル
@@ -34,15 +32,10 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		}
 	}
 	if cfg.CAFile != "" {
-		b, err := os.ReadFile(cfg.CAFile)
+		ca, err := loadCertPool(cfg.CAFile)
 		if err != nil {
 			return nil, err
 		}
-		ca := x509.NewCertPool()
-		ok := ca.AppendCertsFromPEM(b)
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
-		}
 		if cfg.Server {
 			// サーバーの場合はクライアント証明書を要求する
 			tlsConfig.ClientCAs = ca
@@ -56,3 +49,13 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// SetupReloadingTLSConfigは、SetupTLSConfigと同じ設定で、ファイルの変更に合わせて
+// 証明書とCAを読み直すtls.Configを返す。返り値の関数で監視を止める
+func SetupReloadingTLSConfig(cfg TLSConfig, interval time.Duration) (*tls.Config, func(), error) {
+	r, err := NewCertReloader(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.TLSConfig(), r.Watch(interval), nil
+}
+
@@ -1,26 +1,54 @@
 package discovery
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 )
 
+// subscriberBufferは、購読者ごとのイベントチャネルのバッファサイズ
+const subscriberBuffer = 64
+
 type Membership struct {
 	Config
 	handler Handler
 	serf    *serf.Serf
 	events  chan serf.Event
-	logger  *zap.Logger
+	// userEventsは、ユーザーイベントを受け取った順にハンドラへ渡す
+	userEvents chan serf.UserEvent
+	logger     *zap.Logger
+	// doneは、Shutdownでイベントの処理を止めるために閉じる
+	done         chan struct{}
+	shutdownOnce sync.Once
+
+	mu            sync.Mutex
+	subscribers   map[chan Event]struct{}
+	eventHandlers map[string]UserEventHandler
+	queryHandlers map[string]QueryHandler
 }
 
+// handlerがnilの場合は、Subscribeで購読したチャネルにのみイベントを通知する
 func New(handler Handler, config Config) (*Membership, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	c := &Membership{
-		Config:  config,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
+		Config:        config,
+		handler:       handler,
+		logger:        zap.L().Named("membership"),
+		done:          make(chan struct{}),
+		userEvents:    make(chan serf.UserEvent, subscriberBuffer),
+		subscribers:   make(map[chan Event]struct{}),
+		eventHandlers: make(map[string]UserEventHandler),
+		queryHandlers: make(map[string]QueryHandler),
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
@@ -33,6 +61,22 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// EncryptKeysは、ゴシップを暗号化するbase64エンコードされたキー(16、24、32バイト)
+	// 先頭のキーで暗号化し、残りのキーは復号にのみ使う
+	EncryptKeys []string
+	// AllowedNodesは、クラスタへの参加を許可するノード名の一覧
+	// 空の場合は全てのノードの参加を許可する
+	// ノード名は参加するノードが名乗るだけなので、EncryptKeysでキーを持つノードに
+	// 限らなければ、許可された名前を騙るノードを防げない
+	AllowedNodes []string
+}
+
+// Validateは、許可リストで他のノードを防げない設定を拒否する
+func (c Config) Validate() error {
+	if len(c.AllowedNodes) > 0 && len(c.EncryptKeys) == 0 {
+		return errors.New("AllowedNodes requires EncryptKeys")
+	}
+	return nil
 }
 
 func (m *Membership) setupSerf() error {
@@ -50,48 +94,308 @@ func (m *Membership) setupSerf() error {
 	config.EventCh = m.events
 	config.Tags = m.Tags
 	config.NodeName = m.Config.NodeName
+	if len(m.EncryptKeys) > 0 {
+		keyring, err := newKeyring(m.EncryptKeys)
+		if err != nil {
+			return err
+		}
+		config.MemberlistConfig.Keyring = keyring
+	}
+	if len(m.AllowedNodes) > 0 {
+		config.Merge = newAllowlist(m.AllowedNodes)
+	}
 	m.serf, err = serf.Create(config)
 	if err != nil {
 		return err
 	}
 	go m.eventHandler()
-	// 
+	go m.userEventHandler()
 	if m.StartJoinAddrs != nil {
 		_, err := m.serf.Join(m.StartJoinAddrs, true)
 		if err != nil {
+			// 参加に失敗したら、ゴシップとイベントの処理を止めてから返す
+			_ = m.Shutdown()
 			return err
 		}
 	}
 	return nil
 }
 
+// Handlerは、他のノードの参加と離脱を受け取る
+// Joinはノードの参加とタグの更新で、Leaveは正常な離脱と障害で呼ばれる
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error
 }
 
+// EventTypeは、メンバーシップイベントの種類
+type EventType int
+
+const (
+	// EventJoinは、ノードがクラスタに参加したことを表す
+	EventJoin EventType = iota
+	// EventLeaveは、ノードが正常にクラスタから離脱したことを表す
+	EventLeave
+	// EventFailedは、ノードが応答しなくなったことを表す
+	EventFailed
+	// EventUpdateは、ノードのタグが更新されたことを表す
+	EventUpdate
+	// EventReapは、離脱または障害のノードがメンバー一覧から取り除かれたことを表す
+	EventReap
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventFailed:
+		return "failed"
+	case EventUpdate:
+		return "update"
+	case EventReap:
+		return "reap"
+	default:
+		return "unknown"
+	}
+}
+
+// Eventは、購読者に通知されるメンバーシップイベント
+type Event struct {
+	Type EventType
+	Name string
+	Addr string
+	Tags map[string]string
+	// Localは、イベントの対象がこのノード自身かどうか
+	Local bool
+}
+
+var eventTypes = map[serf.EventType]EventType{
+	serf.EventMemberJoin:   EventJoin,
+	serf.EventMemberLeave:  EventLeave,
+	serf.EventMemberFailed: EventFailed,
+	serf.EventMemberUpdate: EventUpdate,
+	serf.EventMemberReap:   EventReap,
+}
+
+// Subscribeは、メンバーシップイベントを受け取るチャネルを返す
+// 返された関数を呼ぶと購読を解除し、チャネルを閉じる
+// 受信が追いつかずバッファが溢れたイベントは破棄される
+func (m *Membership) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subscribers, ch)
+			m.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
 func (m *Membership) eventHandler() {
-	for e := range m.events {
-		switch e.EventType() {
-		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					continue
-				}
-				m.handleJoin(member)
-			}
-
-		case serf.EventMemberLeave, serf.EventMemberFailed:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					return
-				}
-				m.handleLeave(member)
-			}
+	for {
+		var e serf.Event
+		select {
+		case e = <-m.events:
+		case <-m.done:
+			return
+		}
+		switch e := e.(type) {
+		case serf.MemberEvent:
+			m.handleMemberEvent(e)
+		case serf.UserEvent:
+			m.handleUserEvent(e)
+		case *serf.Query:
+			m.handleQuery(e)
 		}
 	}
 }
 
+func (m *Membership) handleMemberEvent(e serf.MemberEvent) {
+	typ, ok := eventTypes[e.EventType()]
+	if !ok {
+		return
+	}
+	for _, member := range e.Members {
+		local := m.isLocal(member)
+		m.publish(Event{
+			Type:  typ,
+			Name:  member.Name,
+			Addr:  member.Tags["rpc_addr"],
+			Tags:  member.Tags,
+			Local: local,
+		})
+		// 自分自身のイベントはハンドラに渡さず、他のメンバーの処理を続ける
+		if local || m.handler == nil {
+			continue
+		}
+		switch typ {
+		case EventJoin, EventUpdate:
+			m.handleJoin(member)
+		case EventLeave, EventFailed:
+			m.handleLeave(member)
+		}
+	}
+}
+
+func (m *Membership) publish(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+			m.logger.Warn(
+				"dropped membership event",
+				zap.String("type", e.Type.String()),
+				zap.String("name", e.Name),
+			)
+		}
+	}
+}
+
+// UserEventHandlerは、クラスタ全体にブロードキャストされたユーザーイベントを処理する
+// ltimeは、送信元のノードが付けたイベントのLamport時刻
+// イベントは届いた順に届くとは限らないので、順序が必要な場合はltimeで比べる
+type UserEventHandler func(ltime uint64, payload []byte)
+
+// QueryHandlerは、クエリを処理して問い合わせ元に返す応答を作る
+type QueryHandler func(payload []byte) ([]byte, error)
+
+// QueryResponseは、クエリに対するノードごとの応答
+type QueryResponse struct {
+	Payload []byte
+	Err     error
+}
+
+const (
+	queryOK byte = iota
+	queryError
+)
+
+// RegisterEventHandlerは、nameのユーザーイベントを受け取るハンドラを登録する
+// ハンドラは、全てのユーザーイベントで共有する1つのゴルーチンから受け取った順に呼ばれる
+// ユーザーイベントは認証されないので、EncryptKeysを設定していない場合は
+// ゴシップのポートに届く誰からのイベントも受け取る
+func (m *Membership) RegisterEventHandler(name string, h UserEventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eventHandlers[name] = h
+}
+
+// RegisterQueryHandlerは、nameのクエリに応答するハンドラを登録する
+// ハンドラはクエリごとに別のゴルーチンで呼ばれる
+func (m *Membership) RegisterQueryHandler(name string, h QueryHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queryHandlers[name] = h
+}
+
+// Encryptedは、ゴシップをEncryptKeysで暗号化しているかを返す
+// 暗号化している場合だけ、ユーザーイベントとクエリの送信元はキーを持つノードに限られる
+func (m *Membership) Encrypted() bool {
+	return m.serf.EncryptionEnabled()
+}
+
+// Broadcastは、自分自身を含むクラスタの全てのノードにユーザーイベントを送る
+func (m *Membership) Broadcast(name string, payload []byte) error {
+	return m.serf.UserEvent(name, payload, false)
+}
+
+// Queryは、クラスタの全てのノードにクエリを送り、timeoutまでに集まった応答を
+// ノード名ごとに返す。timeoutが0の場合はserfの既定値を使う
+func (m *Membership) Query(
+	name string,
+	payload []byte,
+	timeout time.Duration,
+) (map[string]QueryResponse, error) {
+	resp, err := m.serf.Query(name, payload, &serf.QueryParam{
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	responses := make(map[string]QueryResponse)
+	for r := range resp.ResponseCh() {
+		responses[r.From] = decodeQueryResponse(r.Payload)
+	}
+	return responses, nil
+}
+
+// handleUserEventは、ゴシップの処理を止めないように、ハンドラを別のゴルーチンで呼ぶ
+func (m *Membership) handleUserEvent(e serf.UserEvent) {
+	select {
+	case m.userEvents <- e:
+	case <-m.done:
+	}
+}
+
+// userEventHandlerは、ユーザーイベントを受け取った順に1つずつハンドラに渡す
+func (m *Membership) userEventHandler() {
+	for {
+		var e serf.UserEvent
+		select {
+		case e = <-m.userEvents:
+		case <-m.done:
+			return
+		}
+		m.mu.Lock()
+		h, ok := m.eventHandlers[e.Name]
+		m.mu.Unlock()
+		if !ok {
+			m.logger.Debug("no handler for user event", zap.String("name", e.Name))
+			continue
+		}
+		h(uint64(e.LTime), e.Payload)
+	}
+}
+
+func (m *Membership) handleQuery(q *serf.Query) {
+	m.mu.Lock()
+	h, ok := m.queryHandlers[q.Name]
+	m.mu.Unlock()
+	if !ok {
+		m.logger.Debug("no handler for query", zap.String("name", q.Name))
+		return
+	}
+	go func() {
+		payload, err := h(q.Payload)
+		if err := q.Respond(encodeQueryResponse(payload, err)); err != nil {
+			m.logger.Error(
+				"failed to respond to query",
+				zap.String("name", q.Name),
+				zap.Error(err),
+			)
+		}
+	}()
+}
+
+// 応答の先頭の1バイトで、ハンドラが成功したかどうかを伝える
+func encodeQueryResponse(payload []byte, err error) []byte {
+	if err != nil {
+		return append([]byte{queryError}, err.Error()...)
+	}
+	return append([]byte{queryOK}, payload...)
+}
+
+func decodeQueryResponse(b []byte) QueryResponse {
+	if len(b) == 0 {
+		return QueryResponse{}
+	}
+	if b[0] == queryError {
+		return QueryResponse{Err: errors.New(string(b[1:]))}
+	}
+	return QueryResponse{Payload: b[1:]}
+}
+
 func (m *Membership) handleJoin(member serf.Member) {
 	if err := m.handler.Join(
 		member.Name,
@@ -121,6 +425,87 @@ func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
 
+// Shutdownは、ゴシップを止めて待ち受けを閉じる。先にLeaveしないと障害として扱われる
+func (m *Membership) Shutdown() error {
+	err := m.serf.Shutdown()
+	m.shutdownOnce.Do(func() { close(m.done) })
+	return err
+}
+
+// InstallKeyは、クラスタの全てのノードのキーリングにキーを追加する
+func (m *Membership) InstallKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().InstallKey(key))
+}
+
+// UseKeyは、クラスタの全てのノードで暗号化に使うキーを切り替える
+// キーは事前にInstallKeyで追加しておく必要がある
+func (m *Membership) UseKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().UseKey(key))
+}
+
+// RemoveKeyは、クラスタの全てのノードのキーリングからキーを削除する
+func (m *Membership) RemoveKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().RemoveKey(key))
+}
+
+// ListKeysは、キーとそのキーを持つノードの数を返す
+func (m *Membership) ListKeys() (map[string]int, error) {
+	resp, err := m.serf.KeyManager().ListKeys()
+	if err := keyResponseError(resp, err); err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func keyResponseError(resp *serf.KeyResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.NumErr > 0 {
+		return fmt.Errorf(
+			"%d/%d nodes reported failure: %v",
+			resp.NumErr,
+			resp.NumNodes,
+			resp.Messages,
+		)
+	}
+	return nil
+}
+
+func newKeyring(encoded []string) (*memberlist.Keyring, error) {
+	keys := make([][]byte, 0, len(encoded))
+	for _, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encrypt key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+// allowlistは、許可されていないノードのクラスタへの参加を拒否する
+type allowlist map[string]struct{}
+
+var _ serf.MergeDelegate = allowlist(nil)
+
+func newAllowlist(names []string) allowlist {
+	a := make(allowlist, len(names))
+	for _, name := range names {
+		a[name] = struct{}{}
+	}
+	return a
+}
+
+func (a allowlist) NotifyMerge(members []*serf.Member) error {
+	for _, member := range members {
+		if _, ok := a[member.Name]; !ok {
+			return fmt.Errorf("node %q is not allowed to join", member.Name)
+		}
+	}
+	return nil
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	m.logger.Error(
 		msg,
@@ -0,0 +1,338 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			m[0].Members()[2].Status == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
+}
+
+func TestMembershipSubscribe(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	events, unsubscribe := m[0].Subscribe()
+	defer unsubscribe()
+
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	joined := map[string]bool{}
+	for len(joined) < 2 {
+		e := next(t, events)
+		if e.Type == EventJoin && !e.Local {
+			joined[e.Name] = true
+			require.Equal(t, e.Tags["rpc_addr"], e.Addr)
+		}
+	}
+
+	// タグの更新は更新イベントとして通知される
+	require.NoError(t, m[1].serf.SetTags(map[string]string{
+		"rpc_addr": "127.0.0.1:9999",
+	}))
+	e := nextOf(t, events, EventUpdate)
+	require.Equal(t, "1", e.Name)
+	require.Equal(t, "127.0.0.1:9999", e.Addr)
+
+	// 正常な離脱は、障害ではなく離脱イベントとして通知される
+	require.NoError(t, m[2].Leave())
+	e = nextOf(t, events, EventLeave)
+	require.Equal(t, "2", e.Name)
+
+	// 自分自身のイベントを受け取った後も、他のメンバーのイベントを処理し続ける
+	local, unsubscribeLocal := m[1].Subscribe()
+	defer unsubscribeLocal()
+	require.NoError(t, m[1].serf.SetTags(map[string]string{
+		"rpc_addr": "127.0.0.1:9998",
+	}))
+	e = nextOf(t, local, EventUpdate)
+	require.True(t, e.Local)
+	require.NoError(t, m[0].serf.SetTags(map[string]string{
+		"rpc_addr": "127.0.0.1:9997",
+	}))
+	e = nextOf(t, local, EventUpdate)
+	require.False(t, e.Local)
+	require.Equal(t, "0", e.Name)
+}
+
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for membership event")
+	}
+	return Event{}
+}
+
+func nextOf(t *testing.T, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	for {
+		if e := next(t, events); e.Type == typ {
+			return e
+		}
+	}
+}
+
+func TestMembershipEncryption(t *testing.T) {
+	keyA := newKey(t, 1)
+	keyB := newKey(t, 2)
+	withKeys := func(keys ...string) func(*Config) {
+		return func(c *Config) {
+			c.EncryptKeys = keys
+		}
+	}
+
+	m, _ := setupMember(t, nil, withKeys(keyA))
+	m, _ = setupMember(t, m, withKeys(keyA))
+	require.Eventually(t, func() bool {
+		return len(m[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+	require.True(t, m[0].Encrypted())
+
+	// 異なるキーや暗号化していないノードは参加できない
+	_, err := newMember(t, m, withKeys(keyB))
+	require.Error(t, err)
+	_, err = newMember(t, m, nil)
+	require.Error(t, err)
+
+	// キーをローテーションすると、新しいキーだけを持つノードが参加できる
+	require.NoError(t, m[0].InstallKey(keyB))
+	require.NoError(t, m[0].UseKey(keyB))
+	require.NoError(t, m[0].RemoveKey(keyA))
+	keys, err := m[1].ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{keyB: 2}, keys)
+
+	m, _ = setupMember(t, m, withKeys(keyB))
+	require.Eventually(t, func() bool {
+		return len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestMembershipAllowlist(t *testing.T) {
+	key := newKey(t, 1)
+	allow := func(c *Config) {
+		c.EncryptKeys = []string{key}
+		c.AllowedNodes = []string{"0", "1"}
+	}
+	// キーがなければ、許可された名前を騙るノードを防げないので作成できない
+	_, err := newMember(t, nil, func(c *Config) {
+		c.AllowedNodes = []string{"0"}
+	})
+	require.Error(t, err)
+
+	m, _ := setupMember(t, nil, allow)
+	m, _ = setupMember(t, m, allow)
+	require.Eventually(t, func() bool {
+		return len(m[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// 許可されていないノードは、キーを持っていても既存のメンバーに受け入れられない
+	_, _ = newMember(t, m, func(c *Config) {
+		c.EncryptKeys = []string{key}
+	})
+	require.Never(t, func() bool {
+		return len(m[0].Members()) != 2 || len(m[1].Members()) != 2
+	}, 2*time.Second, 250*time.Millisecond)
+}
+
+func TestMembershipUserEvents(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.False(t, m[0].Encrypted())
+
+	received := make(chan string, 2*len(m))
+	ltimes := make(map[string]uint64)
+	var mu sync.Mutex
+	for i, member := range m {
+		name := fmt.Sprintf("%d", i)
+		member.RegisterEventHandler("reload-acls", func(ltime uint64, payload []byte) {
+			mu.Lock()
+			ltimes[name+":"+string(payload)] = ltime
+			mu.Unlock()
+			received <- name + ":" + string(payload)
+		})
+	}
+
+	require.NoError(t, m[0].Broadcast("reload-acls", []byte("v2")))
+	require.NoError(t, m[1].Broadcast("reload-acls", []byte("v3")))
+	got := map[string]bool{}
+	for len(got) < 2*len(m) {
+		select {
+		case r := <-received:
+			got[r] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received only %v", got)
+		}
+	}
+	require.Equal(t, map[string]bool{
+		"0:v2": true,
+		"1:v2": true,
+		"2:v2": true,
+		"0:v3": true,
+		"1:v3": true,
+		"2:v3": true,
+	}, got)
+	// 同じイベントには、全てのノードで送信元が付けた同じLamport時刻が渡される
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"1", "2"} {
+		require.Equal(t, ltimes["0:v2"], ltimes[name+":v2"])
+		require.Equal(t, ltimes["0:v3"], ltimes[name+":v3"])
+	}
+}
+
+func TestMembershipQuery(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(m[0].Members()) == 3
+	}, 3*time.Second, 250*time.Millisecond)
+
+	for i, member := range m {
+		name := fmt.Sprintf("%d", i)
+		member.RegisterQueryHandler("segments", func(payload []byte) ([]byte, error) {
+			if name == "2" {
+				return nil, errors.New("log closed")
+			}
+			return []byte(name + ":" + string(payload)), nil
+		})
+	}
+
+	responses, err := m[0].Query("segments", []byte("count"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, map[string]QueryResponse{
+		"0": {Payload: []byte("0:count")},
+		"1": {Payload: []byte("1:count")},
+		"2": {Err: errors.New("log closed")},
+	}, responses)
+}
+
+func newKey(t *testing.T, b byte) string {
+	t.Helper()
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func setupMember(t *testing.T, members []*Membership, fns ...func(*Config)) (
+	[]*Membership, *handler,
+) {
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 10)
+		h.leaves = make(chan string, 3)
+	}
+	m, err := newMemberWithHandler(t, members, h, fns...)
+	require.NoError(t, err)
+	members = append(members, m)
+	return members, h
+}
+
+func newMember(t *testing.T, members []*Membership, fn func(*Config)) (
+	*Membership, error,
+) {
+	var fns []func(*Config)
+	if fn != nil {
+		fns = append(fns, fn)
+	}
+	return newMemberWithHandler(t, members, &handler{}, fns...)
+}
+
+func newMemberWithHandler(
+	t *testing.T,
+	members []*Membership,
+	h *handler,
+	fns ...func(*Config),
+) (*Membership, error) {
+	id := len(members)
+	addr := freeAddr(t)
+	tags := map[string]string{
+		"rpc_addr": addr,
+	}
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     tags,
+	}
+	if len(members) > 0 {
+		c.StartJoinAddrs = []string{
+			members[0].BindAddr,
+		}
+	}
+	for _, fn := range fns {
+		fn(&c)
+	}
+	m, err := New(h, c)
+	if m != nil {
+		t.Cleanup(func() {
+			m.Shutdown()
+		})
+	}
+	return m, err
+}
+
+// freeAddrは、テスト用に空いているポートのアドレスを返す
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
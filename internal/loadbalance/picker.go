@@ -0,0 +1,61 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &PickerBuilder{}, base.Config{}),
+	)
+}
+
+// PickerBuilderは、接続可能なサーバーが変わるたびにピッカーを作り直す
+type PickerBuilder struct{}
+
+var _ base.PickerBuilder = (*PickerBuilder)(nil)
+
+func (b *PickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		if isLeader(scInfo.Address) {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+// Pickerは、書き込みをリーダーへ、読み出しをフォロワーへラウンドロビンで振り分ける
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Consume") &&
+		len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	n := uint64(len(p.followers))
+	return p.followers[int(cur%n)]
+}
@@ -0,0 +1,139 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// Nameは、リゾルバのスキームとピッカーの名前
+// クライアントは "proglog://<サーバーのアドレス>" をターゲットにしてダイヤルする
+const Name = "proglog"
+
+// RefreshIntervalは、クラスタのトポロジーを定期的に取得し直す間隔
+var RefreshInterval = 10 * time.Second
+
+// isLeaderAttrは、アドレスがリーダーかどうかを示す属性のキー
+type isLeaderAttr struct{}
+
+// Builderは、proglogスキームのリゾルバを作成する
+type Builder struct{}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+func (b *Builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		done:       make(chan struct{}),
+	}
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(
+			dialOpts,
+			grpc.WithTransportCredentials(opts.DialCreds),
+		)
+	}
+	// 解決したアドレスを、このパッケージのピッカーで振り分けるように設定する
+	r.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.Dial(target.Endpoint(), dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+	return r, nil
+}
+
+// Resolverは、GetServersでクラスタのサーバーを発見し、gRPCのクライアントに伝える
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client := api.NewLogClient(r.resolverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), RefreshInterval)
+	defer cancel()
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve server", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderAttr{}, server.IsLeader),
+		})
+	}
+	if err := r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+	}
+}
+
+// refreshは、サーバーの追加やリーダーの交代を反映するために定期的に再解決する
+func (r *Resolver) refresh() {
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		if err := r.resolverConn.Close(); err != nil {
+			r.logger.Error("failed to close conn", zap.Error(err))
+		}
+	})
+}
+
+func isLeader(addr resolver.Address) bool {
+	v, _ := addr.Attributes.Value(isLeaderAttr{}).(bool)
+	return v
+}
@@ -0,0 +1,111 @@
+package loadbalance
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/server"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	serverCreds := credentials.NewTLS(tlsConfig)
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer: &getServers{},
+	}, grpc.Creds(serverCreds))
+	require.NoError(t, err)
+
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	clientCreds := credentials.NewTLS(tlsConfig)
+	opts := resolver.BuildOptions{
+		DialCreds: clientCreds,
+	}
+	b := &Builder{}
+	r, err := b.Build(
+		resolver.Target{URL: url.URL{Path: l.Addr().String()}},
+		conn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	wantAddrs := []resolver.Address{{
+		Addr:       "localhost:9001",
+		Attributes: attributes.New(isLeaderAttr{}, true),
+	}, {
+		Addr:       "localhost:9002",
+		Attributes: attributes.New(isLeaderAttr{}, false),
+	}}
+	require.Equal(t, wantAddrs, conn.state.Addresses)
+
+	conn.state.Addresses = nil
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, wantAddrs, conn.state.Addresses)
+}
+
+type getServers struct{}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}, nil
+}
+
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(
+	config string,
+) *serviceconfig.ParseResult {
+	return nil
+}
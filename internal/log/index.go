@@ -54,6 +54,14 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
+// メモリマップとファイルをディスクに同期する
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 // インデックスを閉じる
 func (i *index) Close() error {
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
@@ -163,6 +163,15 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return l.highestoffset()
 }
 
+// NextOffsetは、次に追記するレコードのオフセットを返す
+// 空のログでもHighestOffsetと違って曖昧にならないので、レプリケーションの開始位置に使う
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[len(l.segments)-1].nextOffset
+}
+
 func (l *Log) highestoffset() (uint64, error) {
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
@@ -177,7 +186,8 @@ func (l *Log) Truncate(lowest uint64) error {
 
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// アクティブセグメントは書き込み先なので削除しない
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -189,6 +199,60 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// SegmentInfoは、セグメントの範囲と大きさを表す
+type SegmentInfo struct {
+	BaseOffset uint64
+	NextOffset uint64
+	StoreBytes uint64
+	IndexBytes uint64
+}
+
+// Segmentsは、古い順にセグメントの情報を返す
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	infos := make([]SegmentInfo, len(l.segments))
+	for i, s := range l.segments {
+		infos[i] = SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.Size(),
+			IndexBytes: s.index.size,
+		}
+	}
+	return infos
+}
+
+// Rollは、新しいアクティブセグメントを作成してそのベースオフセットを返す
+// アクティブセグメントが空の場合は作成しない
+func (l *Log) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return l.activeSegment.baseOffset, nil
+	}
+	off := l.activeSegment.nextOffset
+	if err := l.newSegment(off); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// Syncは、全てのセグメントをディスクに同期する
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
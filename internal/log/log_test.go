@@ -20,6 +20,7 @@ func TestLog(t *testing.T){
 		"init with existing segments": testInitExisting,
 		"reader": testReader,
 		"truncate": testTruncate,
+		"roll and sync segments": testRollSync,
 	}{
 		t.Run(scenario, func(t *testing.T){
 			dir, err := os.MkdirTemp("", "store-test")
@@ -55,6 +56,7 @@ func testOutOfRangeErr(t *testing.T, log *Log){
 }
 
 func testInitExisting(t *testing.T, o *Log){
+	require.Equal(t, uint64(0), o.NextOffset())
 	append := &api.Record{Value: []byte("hello world")}
 	for i := 0; i < 3; i++{
 		_, err := o.Append(append)
@@ -79,6 +81,7 @@ func testInitExisting(t *testing.T, o *Log){
 	off, err = n.HighestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(2), off)
+	require.Equal(t, uint64(3), n.NextOffset())
 	require.NoError(t, n.Close())
 }
 
@@ -116,3 +119,39 @@ func testTruncate(t *testing.T, log *Log){
 	require.NoError(t, log.Close())
 }
 
+
+func testRollSync(t *testing.T, log *Log){
+	append := &api.Record{Value: []byte("hello world")}
+
+	_, err := log.Append(append)
+	require.NoError(t, err)
+
+	off, err := log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// 空のアクティブセグメントはロールしない
+	off, err = log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = log.Append(append)
+	require.NoError(t, err)
+	require.NoError(t, log.Sync())
+
+	segments := log.Segments()
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(1), segments[0].NextOffset)
+	require.Equal(t, uint64(1), segments[1].BaseOffset)
+	require.Equal(t, uint64(2), segments[1].NextOffset)
+	require.Equal(t, uint64(proto.Size(append)+lenWidth), segments[1].StoreBytes)
+	require.Equal(t, entWidth, segments[1].IndexBytes)
+
+	// アクティブセグメントは切り詰めない
+	require.NoError(t, log.Truncate(5))
+	segments = log.Segments()
+	require.Equal(t, 1, len(segments))
+	require.Equal(t, uint64(1), segments[0].BaseOffset)
+	require.NoError(t, log.Close())
+}
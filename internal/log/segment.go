@@ -131,6 +131,14 @@ func (s *segment) Remove() error {
 	return nil
 }
 
+// ストアとインデックスをディスクに同期する
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 // セグメントを閉じる
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
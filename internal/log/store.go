@@ -108,6 +108,25 @@ func (s *store) ReadAt(p []byte, off int64) (int, error){
 	return s.File.ReadAt(p, off)
 }
 
+// バッファを書き出してから、ファイルをディスクに同期する
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// ストアのバイト数を返す
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
 func (s *store) Close() error{
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AckTimeoutが設定されていない場合に、ACKS_ALLでレプリケーションを待つ時間
+const defaultAckTimeout = 10 * time.Second
+
+// ReplicationWaiterは、オフセットまでのレコードが全ての同期中のレプリカに
+// 複製されるまで待つ
+type ReplicationWaiter interface {
+	WaitReplicated(ctx context.Context, offset uint64) error
+}
+
+// syncerは、書き込んだレコードをディスクに同期できるCommitLog
+type syncer interface {
+	Sync() error
+}
+
+// checkAcksは、書き込む前にacksを満たせるかを確認する
+func (c *Config) checkAcks(acks api.Acks) error {
+	switch acks {
+	case api.Acks_ACKS_BUFFERED:
+		return nil
+	case api.Acks_ACKS_LEADER, api.Acks_ACKS_ALL:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown acks: %v", acks)
+	}
+	if _, ok := c.CommitLog.(syncer); !ok {
+		return status.Errorf(codes.FailedPrecondition, "%v is not supported: log cannot sync", acks)
+	}
+	if acks == api.Acks_ACKS_ALL && c.ReplicationWaiter == nil {
+		return status.Errorf(codes.FailedPrecondition, "%v is not supported: replication is not configured", acks)
+	}
+	return nil
+}
+
+// waitAcksは、書き込んだレコードがacksの永続性を満たすまで待つ
+func (c *Config) waitAcks(ctx context.Context, req *api.ProduceRequest, offset uint64) error {
+	if req.Acks == api.Acks_ACKS_BUFFERED {
+		return nil
+	}
+	if err := c.CommitLog.(syncer).Sync(); err != nil {
+		return status.Errorf(codes.Internal, "failed to sync record %d: %v", offset, err)
+	}
+	if req.Acks != api.Acks_ACKS_ALL {
+		return nil
+	}
+
+	timeout := c.AckTimeout
+	if req.AckTimeout != nil {
+		timeout = req.AckTimeout.AsDuration()
+	}
+	if timeout <= 0 {
+		timeout = defaultAckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := c.ReplicationWaiter.WaitReplicated(ctx, offset)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		// レコードは書き込まれているので、オフセットを伝えて再送での重複に気付けるようにする
+		return status.Errorf(
+			codes.DeadlineExceeded,
+			"record %d was not replicated within %s",
+			offset,
+			timeout,
+		)
+	case errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
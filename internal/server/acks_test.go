@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+func TestProduceAcks(t *testing.T) {
+	waiter := &replicationWaiter{replicated: make(chan uint64, 1)}
+	addr, cfg, _, teardown := setupTest(t, func(c *Config) {
+		c.ReplicationWaiter = waiter
+	})
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	for _, acks := range []api.Acks{api.Acks_ACKS_BUFFERED, api.Acks_ACKS_LEADER} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: record, Acks: acks})
+		require.NoError(t, err)
+	}
+
+	// レプリカが追いつくとACKS_ALLの書き込みが返る
+	waiter.replicated <- 2
+	res, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: record,
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	// 追いつかない場合はタイムアウトするが、レコードは書き込まれている
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:     record,
+		Acks:       api.Acks_ACKS_ALL,
+		AckTimeout: durationpb.New(50 * time.Millisecond),
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	_, err = cfg.CommitLog.Read(3)
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Acks: api.Acks(10)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestProduceAcksAllWithoutReplication(t *testing.T) {
+	addr, cfg, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// 満たせないacksの書き込みはログに追加しない
+	_, err = cfg.CommitLog.Read(0)
+	require.Error(t, err)
+}
+
+// replicationWaiterは、replicatedに送られたオフセットまで複製されたとみなす
+type replicationWaiter struct {
+	replicated chan uint64
+}
+
+func (w *replicationWaiter) WaitReplicated(ctx context.Context, offset uint64) error {
+	for {
+		select {
+		case off := <-w.replicated:
+			if off >= offset {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const adminAction = "admin"
+
+// AdminLogは、Adminサービスが状態の確認と保守に使うログの操作
+type AdminLog interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Segments() []log.SegmentInfo
+	Truncate(lowest uint64) error
+	Roll() (uint64, error)
+	Sync() error
+}
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{Config: config}
+}
+
+// 全てのメソッドはadminの権限を必要とする
+// 管理の操作はレコードを読み書きしないので、許可した時点で監査ログに記録する
+func (s *adminServer) authorize(ctx context.Context) error {
+	if err := s.Config.authorize(ctx, objectWildcard, adminAction); err != nil {
+		return err
+	}
+	s.auditAllowed(ctx, objectWildcard, adminAction, nil)
+	return nil
+}
+
+// authorizeLogは、adminの権限とログの保守が設定されていることを確認する
+func (s *adminServer) authorizeLog(ctx context.Context) error {
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	if s.AdminLog == nil {
+		return status.Error(codes.Unimplemented, "log maintenance is not configured")
+	}
+	return nil
+}
+
+// ログのオフセットの範囲とセグメントの一覧を返す
+func (s *adminServer) GetLogInfo(ctx context.Context, req *api.GetLogInfoRequest) (*api.GetLogInfoResponse, error) {
+	if err := s.authorizeLog(ctx); err != nil {
+		return nil, err
+	}
+	lowest, err := s.AdminLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := s.AdminLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetLogInfoResponse{
+		LowestOffset:  lowest,
+		HighestOffset: highest,
+	}
+	for _, seg := range s.AdminLog.Segments() {
+		res.Segments = append(res.Segments, &api.Segment{
+			BaseOffset: seg.BaseOffset,
+			NextOffset: seg.NextOffset,
+			StoreBytes: seg.StoreBytes,
+			IndexBytes: seg.IndexBytes,
+		})
+	}
+	return res, nil
+}
+
+// offsetより前のレコードだけを含むセグメントを削除する
+func (s *adminServer) TruncateBefore(ctx context.Context, req *api.TruncateBeforeRequest) (*api.TruncateBeforeResponse, error) {
+	if err := s.authorizeLog(ctx); err != nil {
+		return nil, err
+	}
+	// Truncateは引数のオフセットまでを含むセグメントを削除する
+	if req.Offset > 0 {
+		if err := s.AdminLog.Truncate(req.Offset - 1); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to truncate: %v", err)
+		}
+	}
+	lowest, err := s.AdminLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.TruncateBeforeResponse{LowestOffset: lowest}, nil
+}
+
+// 新しいアクティブセグメントを作成する
+func (s *adminServer) RollSegment(ctx context.Context, req *api.RollSegmentRequest) (*api.RollSegmentResponse, error) {
+	if err := s.authorizeLog(ctx); err != nil {
+		return nil, err
+	}
+	off, err := s.AdminLog.Roll()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to roll segment: %v", err)
+	}
+	return &api.RollSegmentResponse{BaseOffset: off}, nil
+}
+
+// ログをディスクに同期する
+func (s *adminServer) ForceSync(ctx context.Context, req *api.ForceSyncRequest) (*api.ForceSyncResponse, error) {
+	if err := s.authorizeLog(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.AdminLog.Sync(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sync: %v", err)
+	}
+	return &api.ForceSyncResponse{}, nil
+}
+
+// 時刻の範囲とsubjectで監査ログを検索する
+func (s *adminServer) QueryAudit(ctx context.Context, req *api.QueryAuditRequest) (*api.QueryAuditResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if s.AuditLog == nil {
+		return nil, status.Error(codes.Unimplemented, "audit log is not configured")
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be at most %d", maxAuditLimit)
+	}
+	var start, end time.Time
+	if req.Start != nil {
+		start = req.Start.AsTime()
+	}
+	if req.End != nil {
+		end = req.End.AsTime()
+	}
+	events, err := s.AuditLog.Query(start, end, req.Subject, limit)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to query audit log: %v", err)
+	}
+	return &api.QueryAuditResponse{Events: events}, nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/auth"
+	"github.com/tukki0210/proglog/internal/config"
+)
+
+func TestAdmin(t *testing.T) {
+	addr, cfg, _, teardown := setupTest(t, func(c *Config) {
+		c.AdminLog = c.CommitLog.(AdminLog)
+	})
+	defer teardown()
+
+	conn, err := grpc.Dial(addr, testDialOptions(t,
+		config.RootClientCertFile,
+		config.RootClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewAdminClient(conn)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := cfg.CommitLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		_, err = client.RollSegment(ctx, &api.RollSegmentRequest{})
+		require.NoError(t, err)
+	}
+	_, err = client.ForceSync(ctx, &api.ForceSyncRequest{})
+	require.NoError(t, err)
+
+	info, err := client.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), info.LowestOffset)
+	require.Equal(t, uint64(2), info.HighestOffset)
+	// 最後のロールで空のアクティブセグメントができている
+	require.Equal(t, 4, len(info.Segments))
+	require.Equal(t, uint64(3), info.Segments[3].BaseOffset)
+	require.NotZero(t, info.Segments[0].StoreBytes)
+
+	truncated, err := client.TruncateBefore(ctx, &api.TruncateBeforeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), truncated.LowestOffset)
+	_, err = cfg.CommitLog.Read(1)
+	require.Error(t, err)
+	_, err = cfg.CommitLog.Read(2)
+	require.NoError(t, err)
+
+	nobodyConn, err := grpc.Dial(addr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer nobodyConn.Close()
+	nobody := api.NewAdminClient(nobodyConn)
+
+	_, err = nobody.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.TruncateBefore(ctx, &api.TruncateBeforeRequest{Offset: 3})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAdminPolicies(t *testing.T) {
+	dir, err := os.MkdirTemp("", "policy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authorizer, err := auth.NewPersistent(config.ACLModelFile, config.ACLPolicyFile, dir)
+	require.NoError(t, err)
+	broadcaster := &broadcaster{}
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+		c.PolicyManager = authorizer
+		c.PolicyBroadcaster = broadcaster
+	})
+	defer teardown()
+
+	dial := func(cert, key string) (api.AdminClient, api.LogClient) {
+		conn, err := grpc.Dial(addr, testDialOptions(t, cert, key)...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewAdminClient(conn), api.NewLogClient(conn)
+	}
+	root, _ := dial(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyAdmin, nobody := dial(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+
+	ctx := context.Background()
+	policy := &api.Policy{Subject: "nobody", Object: "orders", Action: "produce"}
+	produce := &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("hello")}}
+
+	_, err = nobody.Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyAdmin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	added, err := root.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	require.True(t, added.Added)
+	added, err = root.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	require.False(t, added.Added)
+	_, err = nobody.Produce(ctx, produce)
+	require.NoError(t, err)
+
+	list, err := root.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+	require.Contains(t, subjects(list.Policies), "nobody")
+
+	// 変更はデータディレクトリに保存され、再起動後も残る
+	reopened, err := auth.NewPersistent(config.ACLModelFile, config.ACLPolicyFile, dir)
+	require.NoError(t, err)
+	require.NoError(t, reopened.Authorize("nobody", "orders", "produce"))
+
+	// 他のノードは、伝えられた変更を適用する
+	dir2, err := os.MkdirTemp("", "policy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	other, err := auth.NewPersistent(config.ACLModelFile, config.ACLPolicyFile, dir2)
+	require.NoError(t, err)
+	replica := NewPolicyReplica(other)
+	for i, payload := range broadcaster.payloads() {
+		replica.HandleEvent(uint64(i+1), payload)
+	}
+	require.NoError(t, other.Authorize("nobody", "orders", "produce"))
+
+	removed, err := root.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	require.True(t, removed.Removed)
+	_, err = nobody.Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	payloads := broadcaster.payloads()
+	require.Equal(t, 2, len(payloads))
+	replica.HandleEvent(2, payloads[1])
+	require.Error(t, other.Authorize("nobody", "orders", "produce"))
+
+	_, err = root.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{Subject: "nobody"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// policy.csvの区切りや行を壊すルールは、Admin APIでも他のノードからの変更でも受け付けない
+	for _, subject := range []string{"a,b", `"nobody"`, "nobody\np, nobody, *, admin", "nobody\r"} {
+		bad := &api.Policy{Subject: subject, Object: "orders", Action: "produce"}
+		_, err = root.AddPolicy(ctx, &api.AddPolicyRequest{Policy: bad})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), subject)
+		_, err = root.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: bad})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), subject)
+
+		payload, err := json.Marshal(policyChange{Subject: subject, Object: "orders", Action: "produce"})
+		require.NoError(t, err)
+		replica.HandleEvent(10, payload)
+		snapshot, err := json.Marshal([]policySnapshotEntry{{
+			policyChange: policyChange{Subject: subject, Object: "*", Action: adminAction},
+			LTime:        11,
+		}})
+		require.NoError(t, err)
+		require.NoError(t, replica.Merge(snapshot))
+	}
+	require.Error(t, other.Authorize("nobody", "orders", adminAction))
+	// 保存したポリシーは壊れず、再び読み込める
+	_, err = auth.NewPersistent(config.ACLModelFile, config.ACLPolicyFile, dir2)
+	require.NoError(t, err)
+	require.NoError(t, other.Reload())
+	require.Len(t, other.Policies(), len(authorizer.Policies()))
+}
+
+func TestPolicyReplica(t *testing.T) {
+	newReplica := func() (*PolicyReplica, *auth.Authorizer) {
+		dir, err := os.MkdirTemp("", "policy-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		a, err := auth.NewPersistent(config.ACLModelFile, config.ACLPolicyFile, dir)
+		require.NoError(t, err)
+		return NewPolicyReplica(a), a
+	}
+	change := func(remove bool) []byte {
+		b, err := json.Marshal(policyChange{
+			Remove:  remove,
+			Subject: "nobody",
+			Object:  "orders",
+			Action:  produceAction,
+		})
+		require.NoError(t, err)
+		return b
+	}
+	add, remove := change(false), change(true)
+	allowed := func(a *auth.Authorizer) bool {
+		return a.Authorize("nobody", "orders", produceAction) == nil
+	}
+
+	// 削除が追加より先に届いても、Lamport時刻の新しい削除が残る
+	replica, authorizer := newReplica()
+	replica.HandleEvent(2, remove)
+	replica.HandleEvent(1, add)
+	require.False(t, allowed(authorizer))
+
+	// 同じLamport時刻で競合した場合は、削除を優先する
+	replica.HandleEvent(3, add)
+	require.True(t, allowed(authorizer))
+	replica.HandleEvent(3, remove)
+	require.False(t, allowed(authorizer))
+	replica.HandleEvent(3, add)
+	require.False(t, allowed(authorizer))
+
+	// 削除を取りこぼしたノードも、スナップショットで同じポリシーに揃う
+	other, otherAuthorizer := newReplica()
+	other.HandleEvent(1, add)
+	require.True(t, allowed(otherAuthorizer))
+	snapshot, err := replica.HandleSnapshotQuery(nil)
+	require.NoError(t, err)
+	require.NoError(t, other.Merge(snapshot))
+	require.False(t, allowed(otherAuthorizer))
+	// スナップショットより古いイベントが遅れて届いても、削除したルールは復活しない
+	other.HandleEvent(2, add)
+	require.False(t, allowed(otherAuthorizer))
+}
+
+func subjects(policies []*api.Policy) []string {
+	var s []string
+	for _, p := range policies {
+		s = append(s, p.Subject)
+	}
+	return s
+}
+
+// broadcasterは、送られたポリシーの変更を記録する
+type broadcaster struct {
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (b *broadcaster) Broadcast(name string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if name == PolicyEventName {
+		b.sent = append(b.sent, payload)
+	}
+	return nil
+}
+
+func (b *broadcaster) payloads() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte(nil), b.sent...)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+)
+
+// AuditLogは、認可の判断を記録して検索する
+type AuditLog interface {
+	Record(event *api.AuditEvent) error
+	Query(start, end time.Time, subject string, limit int) ([]*api.AuditEvent, error)
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// authorizeは、subjectを認可し、拒否した場合は監査ログに記録する
+// 許可した場合は、操作したレコードの範囲が分かってからauditAllowedで記録する
+func (c *Config) authorize(ctx context.Context, object, action string) error {
+	err := c.Authorizer.Authorize(subject(ctx), object, action)
+	if err != nil {
+		c.audit(ctx, object, action, false, nil)
+	}
+	return err
+}
+
+// auditAllowedは、許可した操作を監査ログに記録する
+// offsetsは操作したレコードの範囲で、レコードを操作しなかった場合はnil
+// 転送されてきた書き込みは、転送元のノードが範囲と合わせて記録するので、二重に記録しない
+// リーダーで拒否した場合は転送元では分からないので、authorizeで記録する
+func (c *Config) auditAllowed(ctx context.Context, object, action string, offsets *api.OffsetRange) {
+	if forwarded(ctx) {
+		return
+	}
+	c.audit(ctx, object, action, true, offsets)
+}
+
+// auditは、監査ログに書き込む。書き込みに失敗しても、リクエストは失敗させない
+func (c *Config) audit(
+	ctx context.Context,
+	object, action string,
+	allowed bool,
+	offsets *api.OffsetRange,
+) {
+	if c.AuditLog == nil {
+		return
+	}
+	event := &api.AuditEvent{
+		Subject: subject(ctx),
+		Action:  action,
+		Object:  object,
+		Allowed: allowed,
+		Offsets: offsets,
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		event.Peer = p.Addr.String()
+	}
+	if err := c.AuditLog.Record(event); err != nil {
+		zap.L().Named("audit").Error(
+			"failed to record audit event",
+			zap.Error(err),
+			zap.String("subject", event.Subject),
+			zap.String("action", action),
+		)
+	}
+}
+
+// offsetRangeは、firstからlastまでのレコードの範囲を返す
+func offsetRange(first, last uint64) *api.OffsetRange {
+	return &api.OffsetRange{First: first, Last: last}
+}
+
+// extendは、ストリームで送ったレコードを範囲に加える
+func extend(r *api.OffsetRange, offset uint64) *api.OffsetRange {
+	if r == nil {
+		return offsetRange(offset, offset)
+	}
+	r.Last = offset
+	return r
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/audit"
+	"github.com/tukki0210/proglog/internal/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	auditLog, err := audit.New(dir, audit.Config{})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.AuditLog = auditLog
+	})
+	defer teardown()
+
+	rootConn, root := dialTestClient(t, addr)
+	defer rootConn.Close()
+	nobodyConn, err := grpc.Dial(addr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer nobodyConn.Close()
+	nobody := api.NewLogClient(nobodyConn)
+
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	_, err = root.Produce(ctx, req)
+	require.NoError(t, err)
+	_, err = root.Produce(ctx, req)
+	require.NoError(t, err)
+	_, err = nobody.Produce(ctx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+
+	admin := api.NewAdminClient(rootConn)
+	res, err := admin.QueryAudit(ctx, &api.QueryAuditRequest{Subject: "nobody"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Events))
+	denied := res.Events[0]
+	require.False(t, denied.Allowed)
+	require.Equal(t, produceAction, denied.Action)
+	require.Equal(t, objectWildcard, denied.Object)
+	require.NotEmpty(t, denied.Peer)
+	require.Nil(t, denied.Offsets)
+
+	res, err = admin.QueryAudit(ctx, &api.QueryAuditRequest{Subject: "root"})
+	require.NoError(t, err)
+	// 2回のProduceとConsume、2回の監査ログの検索自体を記録している
+	require.Equal(t, 5, len(res.Events))
+	require.Equal(t, uint64(1), res.Events[1].Offsets.First)
+	require.Equal(t, consumeAction, res.Events[2].Action)
+	require.Equal(t, uint64(1), res.Events[2].Offsets.Last)
+	require.Equal(t, adminAction, res.Events[3].Action)
+	require.Equal(t, adminAction, res.Events[4].Action)
+
+	// 時刻の範囲で絞り込める
+	res, err = admin.QueryAudit(ctx, &api.QueryAuditRequest{
+		Start: denied.Time,
+		End:   denied.Time,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "nobody", res.Events[0].Subject)
+
+	_, err = api.NewAdminClient(nobodyConn).QueryAudit(ctx, &api.QueryAuditRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// ストリームは、レコードごとではなく、終了時に送った範囲を1回だけ記録する
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := root.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	cancel()
+	require.Eventually(t, func() bool {
+		res, err := admin.QueryAudit(ctx, &api.QueryAuditRequest{Subject: "root"})
+		require.NoError(t, err)
+		var consumes []*api.AuditEvent
+		for _, e := range res.Events {
+			if e.Action == consumeAction {
+				consumes = append(consumes, e)
+			}
+		}
+		if len(consumes) != 2 {
+			return false
+		}
+		require.Equal(t, uint64(0), consumes[1].Offsets.First)
+		require.Equal(t, uint64(1), consumes[1].Offsets.Last)
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticatorは、リクエストの資格情報からクライアントのsubjectを取り出す
+type Authenticator interface {
+	// リクエストがこの方式の資格情報を持たない場合はErrNoCredentialsを返し、
+	// 次のAuthenticatorに任せる
+	Authenticate(ctx context.Context) (subject string, err error)
+}
+
+// ErrNoCredentialsは、リクエストがAuthenticatorの方式の資格情報を持たないことを表す
+var ErrNoCredentials = errors.New("no credentials")
+
+// Config.Authenticatorsが設定されていない場合は、クライアント証明書で認証する
+var defaultAuthenticators = []Authenticator{TLSAuthenticator{}}
+
+// authenticateは、Authenticatorを順に試して最初に資格情報を認めたもののsubjectを使う
+// どの資格情報も持たない場合は、空のsubjectとして認可に任せる
+func authenticate(ctx context.Context, authenticators []Authenticator) (context.Context, error) {
+	if len(authenticators) == 0 {
+		authenticators = defaultAuthenticators
+	}
+	for _, a := range authenticators {
+		subject, err := a.Authenticate(ctx)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return ctx, status.Errorf(codes.Unauthenticated, "%v", err)
+		}
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
+	return context.WithValue(ctx, subjectContextKey{}, ""), nil
+}
+
+// TLSAuthenticatorは、検証済みのクライアント証明書からsubjectを取り出す
+type TLSAuthenticator struct {
+	// Subjectsは、順に試すsubjectの取り出し方。省略時はコモンネームを使う
+	Subjects []SubjectMapping
+}
+
+func (a TLSAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	cert := verifiedCertificate(ctx)
+	if cert == nil {
+		return "", ErrNoCredentials
+	}
+	return certificateSubject(cert, a.Subjects)
+}
+
+// verifiedCertificateは、検証済みのクライアント証明書を返す。ない場合はnilを返す
+func verifiedCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 ||
+		len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+// JWTConfigは、ベアラートークンの検証の設定
+type JWTConfig struct {
+	// JWKSFileは、トークンの署名を検証する公開鍵のJWKSファイル
+	JWKSFile string
+	// Issuerが設定されている場合、issクレームが一致するトークンだけを受け付ける
+	Issuer string
+	// Audienceが設定されている場合、audクレームに含むトークンだけを受け付ける
+	Audience string
+}
+
+// JWTAuthenticatorは、authorizationメタデータのベアラートークンを検証し、
+// subクレームをsubjectにする
+type JWTAuthenticator struct {
+	keys   map[string]crypto.PublicKey
+	parser *jwt.Parser
+}
+
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	keys, err := loadJWKS(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{
+			"RS256", "RS384", "RS512",
+			"PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512",
+		}),
+		jwt.WithExpirationRequired(),
+	}
+	if config.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(config.Audience))
+	}
+	return &JWTAuthenticator{
+		keys:   keys,
+		parser: jwt.NewParser(opts...),
+	}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	token, ok := bearerToken(ctx)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	parsed, err := a.parser.Parse(token, a.key)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+	subject, err := parsed.Claims.GetSubject()
+	if err != nil || subject == "" {
+		return "", errors.New("invalid token: missing sub claim")
+	}
+	return subject, nil
+}
+
+// keyは、トークンのkidに対応する公開鍵を返す
+// kidがない場合は、鍵が1つだけのときに限りその鍵を使う
+func (a *JWTAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	key, ok := a.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, v := range md.Get("authorization") {
+		scheme, token, ok := strings.Cut(v, " ")
+		if ok && strings.EqualFold(scheme, "bearer") {
+			return strings.TrimSpace(token), true
+		}
+	}
+	return "", false
+}
+
+// jwkは、JWKSの1つの鍵。RSAとECの公開鍵に対応する
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func loadJWKS(name string) (map[string]crypto.PublicKey, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks %s: %w", name, err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		// 署名用ではない鍵は使わない
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in %s: %w", k.Kid, name, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in %s", name)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// apiKeyMetadataKeyは、静的なAPIキーを渡すメタデータのキー
+const apiKeyMetadataKey = "x-api-key"
+
+// APIKeyAuthenticatorは、x-api-keyメタデータの静的なAPIキーをsubjectに対応付ける
+type APIKeyAuthenticator struct {
+	// キーそのものではなくハッシュで引くことで、比較の時間からキーを推測されないようにする
+	subjects map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyAuthenticatorは、APIキーからsubjectへの対応でAuthenticatorを作成する
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	subjects := make(map[[sha256.Size]byte]string, len(keys))
+	for key, subject := range keys {
+		subjects[sha256.Sum256([]byte(key))] = subject
+	}
+	return &APIKeyAuthenticator{subjects: subjects}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	values := md.Get(apiKeyMetadataKey)
+	if len(values) == 0 {
+		return "", ErrNoCredentials
+	}
+	subject, ok := a.subjects[sha256.Sum256([]byte(values[0]))]
+	if !ok {
+		return "", errors.New("invalid api key")
+	}
+	return subject, nil
+}
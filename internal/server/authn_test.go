@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/config"
+)
+
+func TestAuthenticateChain(t *testing.T) {
+	// 資格情報がない場合は空のsubjectになる
+	ctx, err := authenticate(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	// TLS以外の接続でもパニックしない
+	ctx = peer.NewContext(context.Background(), &peer.Peer{AuthInfo: otherAuthInfo{}})
+	ctx, err = authenticate(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	apiKeys := NewAPIKeyAuthenticator(map[string]string{"secret": "root"})
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		apiKeyMetadataKey, "secret",
+	))
+	ctx, err = authenticate(ctx, []Authenticator{TLSAuthenticator{}, apiKeys})
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(ctx))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		apiKeyMetadataKey, "wrong",
+	))
+	_, err = authenticate(ctx, []Authenticator{apiKeys})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks := writeJWKS(t, "test-key", &key.PublicKey)
+
+	a, err := NewJWTAuthenticator(JWTConfig{
+		JWKSFile: jwks,
+		Issuer:   "https://issuer.example",
+		Audience: "proglog",
+	})
+	require.NoError(t, err)
+
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "root",
+			"iss": "https://issuer.example",
+			"aud": "proglog",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	sign := func(kid string, c jwt.MapClaims) context.Context {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, c)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"authorization", "Bearer "+signed,
+		))
+	}
+
+	subject, err := a.Authenticate(sign("test-key", claims()))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	_, err = a.Authenticate(context.Background())
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	expired := claims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://other.example"
+	noSubject := claims()
+	delete(noSubject, "sub")
+	noExpiry := claims()
+	delete(noExpiry, "exp")
+	for name, ctx := range map[string]context.Context{
+		"expired":      sign("test-key", expired),
+		"wrong issuer": sign("test-key", wrongIssuer),
+		"no subject":   sign("test-key", noSubject),
+		"no expiry":    sign("test-key", noExpiry),
+		"unknown key":  sign("other-key", claims()),
+	} {
+		_, err := a.Authenticate(ctx)
+		require.Error(t, err, name)
+		require.NotErrorIs(t, err, ErrNoCredentials, name)
+	}
+}
+
+func TestAuthenticatorsOnRPCs(t *testing.T) {
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authenticators = []Authenticator{
+			NewAPIKeyAuthenticator(map[string]string{"root-key": "root"}),
+			TLSAuthenticator{},
+		}
+	})
+	defer teardown()
+
+	// nobodyの証明書で接続しても、APIキーがあればそのsubjectで認可する
+	conn, err := grpc.Dial(addr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	_, err = client.Produce(context.Background(), req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadataKey, "root-key")
+	_, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadataKey, "wrong")
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+type otherAuthInfo struct{}
+
+func (otherAuthInfo) AuthType() string { return "other" }
+
+func writeJWKS(t *testing.T, kid string, key *ecdsa.PublicKey) string {
+	t.Helper()
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []jwk{{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   encode(key.X.FillBytes(make([]byte, 32))),
+			Y:   encode(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+	require.NoError(t, err)
+	name := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(name, b, 0600))
+	return name
+}
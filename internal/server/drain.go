@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// errDrainingは、ドレイン中のサーバーがストリームを終わらせるときのエラー
+// クライアントはUnavailableを受け取ったら、別のノードか再起動後のノードで再試行できる
+var errDraining = status.Error(codes.Unavailable, "server is draining")
+
+// Drainerは、サーバーの停止前に新しいストリームを拒否し、実行中のストリームに終了を伝える
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	done     chan struct{}
+	streams  sync.WaitGroup
+}
+
+func NewDrainer() *Drainer {
+	return &Drainer{
+		done: make(chan struct{}),
+	}
+}
+
+// Drainは、ドレインモードに入る。複数回呼んでも問題ない
+func (d *Drainer) Drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.draining {
+		d.draining = true
+		close(d.done)
+	}
+}
+
+// Doneは、ドレインモードに入ると閉じられるチャネルを返す
+func (d *Drainer) Done() <-chan struct{} {
+	return d.done
+}
+
+// Waitは、実行中のストリームが全て終わるか、ctxが終わるまで待つ
+func (d *Drainer) Wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		d.streams.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startは、ストリームの開始を記録する。ドレイン中の場合はfalseを返す
+func (d *Drainer) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.streams.Add(1)
+	return true
+}
+
+func (d *Drainer) finish() {
+	d.streams.Done()
+}
+
+// startStreamは、HTTPのストリームをDrainerに登録する。ドレイン中の場合はfalseを返す
+// gRPCのストリームと同じく、Drainer.Waitは登録したストリームが終わるまで待つ
+// 返された関数でストリームの終了を伝える
+func (c *Config) startStream() (func(), bool) {
+	if c.Drainer == nil {
+		return func() {}, true
+	}
+	if !c.Drainer.start() {
+		return nil, false
+	}
+	return c.Drainer.finish, true
+}
+
+// logStreamPrefixは、ドレインで終わらせるLogサービスのメソッド名の接頭辞
+var logStreamPrefix = "/" + api.Log_ServiceDesc.ServiceName + "/"
+
+// StreamServerInterceptorは、ドレイン中の新しいストリームを拒否し、実行中のストリームを数える
+// ヘルスチェックのWatchなどLogサービス以外のストリームはドレインを待たず、
+// ドレインに入ったらコンテキストを取り消して終わらせる
+func (d *Drainer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if !strings.HasPrefix(info.FullMethod, logStreamPrefix) {
+			ctx, cancel := context.WithCancel(stream.Context())
+			defer cancel()
+			go func() {
+				select {
+				case <-d.done:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			return handler(srv, &drainingStream{ServerStream: stream, ctx: ctx})
+		}
+		if !d.start() {
+			return errDraining
+		}
+		defer d.finish()
+		return handler(srv, stream)
+	}
+}
+
+// drainingStreamは、ドレインに入ると取り消されるコンテキストを返すストリーム
+type drainingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *drainingStream) Context() context.Context {
+	return s.ctx
+}
+
+// drainingは、ドレインモードに入ると閉じられるチャネルを返す
+// Drainerが設定されていない場合は、閉じられることのないnilを返す
+func (c *Config) draining() <-chan struct{} {
+	if c.Drainer == nil {
+		return nil
+	}
+	return c.Drainer.Done()
+}
+
+// GracefulStopは、ストリームをドレインしてからgRPCサーバーを停止し、ログを閉じる
+// ctxが終わるまでに停止しない場合は、残りの接続を強制的に閉じる
+func GracefulStop(ctx context.Context, gsrv *grpc.Server, config *Config) error {
+	if config.Health != nil {
+		config.Health.Shutdown()
+	}
+
+	var errs []error
+	if config.Drainer != nil {
+		config.Drainer.Drain()
+		if err := config.Drainer.Wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		gsrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		gsrv.Stop()
+		<-stopped
+		errs = append(errs, ctx.Err())
+	}
+
+	if config.forwarder != nil {
+		if err := config.forwarder.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Closeはバッファをファイルに書き出してから閉じる
+	if closer, ok := config.CommitLog.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
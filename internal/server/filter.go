@@ -0,0 +1,363 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode"
+
+	api "github.com/tukki0210/proglog/api/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// フィルターで読み飛ばしたレコードがこの件数に達したら、進捗を送る
+const filterProgressInterval = 1000
+
+// 式の解析は再帰するため、長さと入れ子の深さを制限してスタックの枯渇を防ぐ
+const (
+	maxFilterExprLen   = 4096
+	maxFilterExprDepth = 32
+)
+
+// recordFilterは、ConsumeRequestのFilterをコンパイルしたもの
+type recordFilter struct {
+	headerEquals map[string]string
+	keyPrefix    []byte
+	expr         filterExpr
+}
+
+// compileFilterは、フィルターを検証してコンパイルする。nilのフィルターは全てに一致する
+func compileFilter(f *api.Filter) (*recordFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	filter := &recordFilter{
+		headerEquals: f.HeaderEquals,
+		keyPrefix:    f.KeyPrefix,
+	}
+	if f.Expression != "" {
+		expr, err := parseFilterExpr(f.Expression)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"invalid filter expression: %v",
+				err,
+			)
+		}
+		filter.expr = expr
+	}
+	return filter, nil
+}
+
+func (f *recordFilter) match(record *api.Record) bool {
+	if f == nil {
+		return true
+	}
+	for k, v := range f.headerEquals {
+		if got, ok := record.Headers[k]; !ok || got != v {
+			return false
+		}
+	}
+	if !bytes.HasPrefix(record.Key, f.keyPrefix) {
+		return false
+	}
+	if f.expr != nil && !f.expr.eval(record.Headers) {
+		return false
+	}
+	return true
+}
+
+// filterExprは、ヘッダーに対するCELに似た小さな式
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" expr ")" | "has(" header ")" | operand ("==" | "!=") operand
+//	operand = header | string
+//	header  = "headers" ( "." ident | "[" string "]" )
+//
+// 存在しないヘッダーはどの値とも等しくない
+type filterExpr interface {
+	eval(headers map[string]string) bool
+}
+
+type (
+	orExpr    struct{ left, right filterExpr }
+	andExpr   struct{ left, right filterExpr }
+	notExpr   struct{ expr filterExpr }
+	hasExpr   struct{ name string }
+	equalExpr struct{ left, right operand }
+)
+
+func (e orExpr) eval(h map[string]string) bool  { return e.left.eval(h) || e.right.eval(h) }
+func (e andExpr) eval(h map[string]string) bool { return e.left.eval(h) && e.right.eval(h) }
+func (e notExpr) eval(h map[string]string) bool { return !e.expr.eval(h) }
+
+func (e hasExpr) eval(h map[string]string) bool {
+	_, ok := h[e.name]
+	return ok
+}
+
+func (e equalExpr) eval(h map[string]string) bool {
+	l, lok := e.left.value(h)
+	r, rok := e.right.value(h)
+	return lok && rok && l == r
+}
+
+// operandは、ヘッダーの参照か文字列リテラル
+type operand struct {
+	header  bool
+	literal string
+}
+
+func (o operand) value(h map[string]string) (string, bool) {
+	if !o.header {
+		return o.literal, true
+	}
+	v, ok := h[o.literal]
+	return v, ok
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			lit := src[start:i]
+			if c == '\'' {
+				lit = `"` + lit[1:len(lit)-1] + `"`
+			}
+			s, err := strconv.Unquote(lit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", start, err)
+			}
+			toks = append(toks, token{tokString, s, start})
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "&&", "||", "!", "(", ")", "[", "]", "."} {
+				if len(src)-i >= len(o) && src[i:i+len(o)] == o {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+type exprParser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func parseFilterExpr(src string) (filterExpr, error) {
+	if len(src) > maxFilterExprLen {
+		return nil, fmt.Errorf("expression is longer than %d bytes", maxFilterExprLen)
+	}
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *exprParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// acceptは、次のトークンが演算子opの場合に読み進める
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at %d", op, t.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (filterExpr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterExprDepth {
+		return nil, fmt.Errorf("expression is nested deeper than %d at %d", maxFilterExprDepth, p.peek().pos)
+	}
+	if p.accept("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	if t := p.peek(); t.kind == tokIdent && t.text == "has" {
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		name, err := p.parseHeader()
+		if err != nil {
+			return nil, err
+		}
+		return hasExpr{name}, p.expect(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	negate := false
+	switch {
+	case p.accept("=="):
+	case p.accept("!="):
+		negate = true
+	default:
+		t := p.peek()
+		return nil, fmt.Errorf("expected comparison at %d", t.pos)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	var expr filterExpr = equalExpr{left, right}
+	if negate {
+		expr = notExpr{expr}
+	}
+	return expr, nil
+}
+
+func (p *exprParser) parseOperand() (operand, error) {
+	if t := p.peek(); t.kind == tokString {
+		p.next()
+		return operand{literal: t.text}, nil
+	}
+	name, err := p.parseHeader()
+	if err != nil {
+		return operand{}, err
+	}
+	return operand{header: true, literal: name}, nil
+}
+
+// parseHeaderは、headers.nameかheaders["name"]を読んでヘッダー名を返す
+func (p *exprParser) parseHeader() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent || t.text != "headers" {
+		return "", fmt.Errorf("expected headers or string at %d", t.pos)
+	}
+	if p.accept(".") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return "", fmt.Errorf("expected header name at %d", t.pos)
+		}
+		return t.text, nil
+	}
+	if err := p.expect("["); err != nil {
+		return "", err
+	}
+	t = p.next()
+	if t.kind != tokString {
+		return "", fmt.Errorf("expected header name at %d", t.pos)
+	}
+	return t.text, p.expect("]")
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+func TestFilterExpression(t *testing.T) {
+	headers := map[string]string{"type": "order", "region": "jp"}
+	for expr, want := range map[string]bool{
+		`headers["type"] == "order"`:                           true,
+		`headers.type == 'order'`:                              true,
+		`headers.type != "order"`:                              false,
+		`"jp" == headers.region && headers.type == "order"`:    true,
+		`headers.type == "refund" || headers.region == "jp"`:   true,
+		`!(headers.type == "order" || headers.region == "us")`: false,
+		`has(headers.region) && !has(headers["test"])`:         true,
+		`headers.missing == ""`:                                false,
+		`headers.missing != "x"`:                               true,
+	} {
+		f, err := parseFilterExpr(expr)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, f.eval(headers), expr)
+	}
+
+	for _, expr := range []string{
+		``,
+		`headers.type`,
+		`headers.type == `,
+		`headers["type"] == "order`,
+		`(headers.type == "order"`,
+		`type == "order"`,
+		`headers.type == "order" extra`,
+		`has(headers.type`,
+	} {
+		_, err := parseFilterExpr(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestFilterExpressionLimits(t *testing.T) {
+	// 深い入れ子でもスタックを使い果たさずにエラーを返す
+	deep := strings.Repeat("(", 100000) + `headers.type == "order"` + strings.Repeat(")", 100000)
+	_, err := compileFilter(&api.Filter{Expression: deep})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	nested := strings.Repeat("!", maxFilterExprLen-100) + `headers.type == "order"`
+	_, err = compileFilter(&api.Filter{Expression: nested})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	long := `headers.type == "` + strings.Repeat("x", maxFilterExprLen) + `"`
+	_, err = compileFilter(&api.Filter{Expression: long})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// 制限までの入れ子は受け付ける
+	ok := strings.Repeat("(", maxFilterExprDepth-1) + `headers.type == "order"` + strings.Repeat(")", maxFilterExprDepth-1)
+	_, err = compileFilter(&api.Filter{Expression: ok})
+	require.NoError(t, err)
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := compileFilter(&api.Filter{
+		HeaderEquals: map[string]string{"type": "order"},
+		KeyPrefix:    []byte("user-"),
+		Expression:   `headers.region != "us"`,
+	})
+	require.NoError(t, err)
+
+	record := func(key string, headers map[string]string) *api.Record {
+		return &api.Record{Key: []byte(key), Headers: headers}
+	}
+	require.True(t, f.match(record("user-1", map[string]string{"type": "order"})))
+	require.False(t, f.match(record("user-1", map[string]string{"type": "refund"})))
+	require.False(t, f.match(record("item-1", map[string]string{"type": "order"})))
+	require.False(t, f.match(record("user-1", map[string]string{"type": "order", "region": "us"})))
+
+	// フィルターがない場合は全てに一致する
+	none, err := compileFilter(nil)
+	require.NoError(t, err)
+	require.True(t, none.match(record("", nil)))
+
+	_, err = compileFilter(&api.Filter{Expression: "headers.type =="})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConsumeStreamFilter(t *testing.T) {
+	addr, cfg, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	for _, typ := range []string{"order", "refund", "order", "refund", "refund"} {
+		_, err := cfg.CommitLog.Append(&api.Record{
+			Value:   []byte(typ),
+			Headers: map[string]string{"type": typ},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{
+		Filter: &api.Filter{HeaderEquals: map[string]string{"type": "order"}},
+	})
+	require.NoError(t, err)
+
+	for _, off := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+		require.Equal(t, off, res.ScannedOffset)
+	}
+
+	// 末尾まで読み飛ばすと、レコードなしで進捗だけを知らせる
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Equal(t, uint64(4), res.ScannedOffset)
+
+	bad, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{
+		Filter: &api.Filter{Expression: "headers.type =="},
+	})
+	require.NoError(t, err)
+	_, err = bad.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/config"
+)
+
+// forwardedSubjectKeyは、転送元のクライアントのsubjectを伝えるメタデータのキー
+const forwardedSubjectKey = "proglog-forwarded-subject"
+
+// subjectTagは、認証したsubjectをリクエストのログに含めるタグ
+const subjectTag = "auth.subject"
+
+// LeaderFinderは、書き込みを受け付けるリーダーを探す
+type LeaderFinder interface {
+	// Leaderは、リーダーのRPCアドレスと、このノード自身がリーダーかどうかを返す
+	Leader() (addr string, local bool, err error)
+}
+
+type forwardedContextKey struct{}
+
+// forwarderは、リーダーへの接続を保持して書き込みを転送する
+type forwarder struct {
+	mu       sync.Mutex
+	dialOpts []grpc.DialOption
+	addr     string
+	conn     *grpc.ClientConn
+}
+
+func newForwarder(dialOpts []grpc.DialOption) *forwarder {
+	return &forwarder{dialOpts: dialOpts}
+}
+
+// initForwarderは、gRPCとHTTPのサーバーが同じリーダーへの接続を使うように、一度だけ作る
+func (c *Config) initForwarder() {
+	if c.forwarder == nil {
+		c.forwarder = newForwarder(c.ForwardDialOptions)
+	}
+}
+
+func (f *forwarder) Produce(
+	ctx context.Context,
+	addr string,
+	req *api.ProduceRequest,
+) (*api.ProduceResponse, error) {
+	// 転送されてきた書き込みを再び転送すると、リーダーの交代中にループするため拒否する
+	if forwarded(ctx) {
+		return nil, status.Error(
+			codes.Unavailable,
+			"forwarded produce received by a node that is not the leader",
+		)
+	}
+	client, err := f.client(addr)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Unavailable,
+			"failed to connect to leader: %v",
+			err,
+		)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(
+		forwardedSubjectKey, subject(ctx),
+	))
+	return client.Produce(ctx, req)
+}
+
+// clientは、リーダーへの接続を返す。リーダーが変わった場合は古い接続を閉じる
+func (f *forwarder) client(addr string) (api.LogClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == nil || f.addr != addr {
+		conn, err := grpc.Dial(addr, f.dialOpts...)
+		if err != nil {
+			return nil, err
+		}
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		f.addr = addr
+		f.conn = conn
+	}
+	return api.NewLogClient(f.conn), nil
+}
+
+// Closeは、リーダーへの接続を閉じる
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	f.addr = ""
+	return err
+}
+
+// authenticateは、クライアントを認証した上で、信頼できるノードから
+// 転送されたリクエストの場合は転送元のクライアントのsubjectに置き換える
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	ctx, err := authenticate(ctx, s.Authenticators)
+	if err != nil {
+		return ctx, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(forwardedSubjectKey)
+	if len(values) > 0 && s.trustedForwarder(ctx) {
+		ctx = context.WithValue(ctx, subjectContextKey{}, values[0])
+		ctx = context.WithValue(ctx, forwardedContextKey{}, true)
+	}
+	// リクエストのログに、認可に使うsubjectを含める
+	grpc_ctxtags.Extract(ctx).Set(subjectTag, subject(ctx))
+	return ctx, nil
+}
+
+// trustedForwarderは、クライアントがTrustedForwardersのノードの証明書で接続しているかを返す
+// トークンのsubjectやただのコモンネームは利用者のsubjectと衝突しうるため、
+// OUにconfig.NodeOUを持つ検証済みのクライアント証明書だけを信頼する
+func (c *Config) trustedForwarder(ctx context.Context) bool {
+	cert := verifiedCertificate(ctx)
+	if cert == nil || !contains(cert.Subject.OrganizationalUnit, config.NodeOU) {
+		return false
+	}
+	return contains(c.TrustedForwarders, cert.Subject.CommonName)
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func forwarded(ctx context.Context) bool {
+	v, _ := ctx.Value(forwardedContextKey{}).(bool)
+	return v
+}
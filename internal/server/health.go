@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// ヘルスチェックで状態を問い合わせられるコンポーネントのサービス名
+const (
+	HealthLog         = "proglog.log"
+	HealthMembership  = "proglog.membership"
+	HealthReplication = "proglog.replication"
+)
+
+// Healthは、grpc.health.v1のサービスでコンポーネントごとの状態を公開する
+// 全てのコンポーネントが正常な場合にだけ、サーバー全体(サービス名"")と
+// Logサービスを SERVING にする
+type Health struct {
+	*health.Server
+
+	mu         sync.Mutex
+	components map[string]bool
+}
+
+// NewHealthは、componentsを監視するHealthを作る。全てのコンポーネントは
+// SetHealthyで正常になるまで NOT_SERVING として扱う
+func NewHealth(components ...string) *Health {
+	h := &Health{
+		Server:     health.NewServer(),
+		components: make(map[string]bool, len(components)),
+	}
+	for _, c := range components {
+		h.components[c] = false
+	}
+	h.updateLocked()
+	return h
+}
+
+// SetHealthyは、コンポーネントの状態を更新する
+func (h *Health) SetHealthy(component string, healthy bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.components[component] = healthy
+	h.updateLocked()
+}
+
+func (h *Health) updateLocked() {
+	overall := healthpb.HealthCheckResponse_SERVING
+	for c, healthy := range h.components {
+		st := healthpb.HealthCheckResponse_SERVING
+		if !healthy {
+			st = healthpb.HealthCheckResponse_NOT_SERVING
+			overall = st
+		}
+		h.Server.SetServingStatus(c, st)
+	}
+	h.Server.SetServingStatus("", overall)
+	h.Server.SetServingStatus(api.Log_ServiceDesc.ServiceName, overall)
+}
@@ -1,17 +1,45 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/tukki0210/proglog/api/v1"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// NewHTTPServerは、gRPCサーバーと同じCommitLogとAuthorizerを使うHTTPサーバーを作る
+// クライアント証明書で認証する場合は、返されたサーバーのTLSConfigを設定する
+func NewHTTPServer(addr string, config *Config) *http.Server {
+	httpsrv := newHTTPServer(config)
 	r := mux.NewRouter()
+	r.HandleFunc("/records", httpsrv.handleProduceRecord).Methods("POST")
+	r.HandleFunc("/records", httpsrv.handleListRecords).Methods("GET")
+	r.HandleFunc("/records/{offset:[0-9]+}", httpsrv.handleConsumeRecord).Methods("GET")
+	r.HandleFunc("/records/stream", httpsrv.handleStreamRecords).Methods("GET")
+	r.HandleFunc("/records/ws/produce", httpsrv.handleProduceWebSocket).Methods("GET")
+	r.HandleFunc("/records/ws/consume", httpsrv.handleConsumeWebSocket).Methods("GET")
+	// 既存のクライアントのために、ボディでリクエストを受け取るルートも残す
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	r.Use(httpsrv.authenticate)
 	return &http.Server {
 		Addr: addr,
 		Handler: r,
@@ -20,17 +48,21 @@ func NewHTTPServer(addr string) *http.Server {
 
 
 type httpServer struct {
-	Log *Log
+	*Config
 }
+
 // httpServerのFactory()
-func newHTTPServer() *httpServer {
+func newHTTPServer(config *Config) *httpServer {
+	config.initForwarder()
 	return &httpServer{
-		Log: NewLog(),
+		Config: config,
 	}
 }
 
 type ProduceRequest struct {
-	Record Record `json:"record"`
+	// Topicは、topicのクエリパラメータの代わりにボディで指定する書き込み先のトピック
+	Topic  string      `json:"topic,omitempty"`
+	Record *api.Record `json:"record"`
 }
 
 type ProduceResponse struct {
@@ -38,35 +70,73 @@ type ProduceResponse struct {
 }
 
 type ConsumeRequest struct {
+	Topic  string `json:"topic,omitempty"`
 	Offset uint64 `json:"offset"`
 }
 
 type ConsumeResponse struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
+}
+
+type ListRecordsResponse struct {
+	Records []*api.Record `json:"records"`
+	// Nextは、続きを読むときにfromに指定するオフセット
+	Next uint64 `json:"next"`
 }
 
+const (
+	contentTypeJSON  = "application/json"
+	contentTypeBytes = "application/octet-stream"
+
+	// offsetHeaderは、レコードを生のバイト列で返すときにオフセットを伝えるヘッダ
+	offsetHeader = "Proglog-Offset"
+
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// maxListScanは、トピックを指定した一覧で1回に読み飛ばすレコードの最大数
+	// 他のトピックのレコードが続いても、応答を返せるようにする
+	maxListScan = 10 * maxListLimit
+)
 
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request){
 	defer r.Body.Close()
 
+	acks, err := queryAcks(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Record == nil {
+		http.Error(w, "invalid produce request", http.StatusBadRequest)
+		return
+	}
+	topic, err := requestTopic(r, req.Topic)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		return 
+		return
+	}
+
+	if err := s.authorize(r.Context(), object(topic), produceAction); err != nil {
+		httpError(w, err)
+		return
 	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), produceAction, offsets) }()
 
-	off, err := s.Log.Append(req.Record)
+	produced, err := s.produceRecord(r.Context(), topic, req.Record, acks)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return 
+		httpError(w, err)
+		return
 	}
+	offsets = offsetRange(produced.Offset, produced.Offset)
 
-	res := ProduceResponse{Offset: off}
+	res := ProduceResponse{Offset: produced.Offset}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return 
+		return
 	}
 }
 
@@ -79,22 +149,371 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request){
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return 
 	}
+	topic, err := requestTopic(r, req.Topic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return 
+	if err := s.authorize(r.Context(), object(topic), consumeAction); err != nil {
+		httpError(w, err)
+		return
 	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), consumeAction, offsets) }()
 
+	if err := s.allowQuota(r.Context(), consumeAction, 0); err != nil {
+		httpError(w, err)
+		return
+	}
+	record, err := s.readRecord(req.Offset, topic)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return 
+		httpError(w, err)
+		return
 	}
+	offsets = offsetRange(req.Offset, req.Offset)
+	s.chargeConsume(r.Context(), record)
 
 	res := ConsumeResponse{Record: record}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return 
+		return
+	}
+}
+
+// handleProduceRecordは、JSONのProduceRequestか、生のバイト列をレコードの値として書き込む
+func (s *httpServer) handleProduceRecord(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	acks, err := queryAcks(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var record *api.Record
+	var bodyTopic string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeBytes:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record = &api.Record{Value: value}
+	case contentTypeJSON, "":
+		var req ProduceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Record == nil {
+			http.Error(w, "invalid produce request", http.StatusBadRequest)
+			return
+		}
+		record, bodyTopic = req.Record, req.Topic
+	default:
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	topic, err := requestTopic(r, bodyTopic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.authorize(r.Context(), object(topic), produceAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), produceAction, offsets) }()
+
+	res, err := s.produceRecord(r.Context(), topic, record, acks)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	offsets = offsetRange(res.Offset, res.Offset)
+	writeJSON(w, http.StatusCreated, ProduceResponse{Offset: res.Offset})
+}
+
+// produceRecordは、HTTPとWebSocketで受け取ったレコードを、gRPCのProduceと同じく
+// クォータ、リーダーへの転送、acksを適用して書き込む
+func (s *httpServer) produceRecord(
+	ctx context.Context,
+	topic string,
+	record *api.Record,
+	acks api.Acks,
+) (*api.ProduceResponse, error) {
+	req := &api.ProduceRequest{Topic: topic, Record: record, Acks: acks}
+	if err := s.allowQuota(ctx, produceAction, float64(proto.Size(req))); err != nil {
+		return nil, err
+	}
+	return s.produce(ctx, req)
+}
+
+// readRecordは、オフセットのレコードがトピックに含まれる場合だけ返す
+func (s *httpServer) readRecord(offset uint64, topic string) (*api.Record, error) {
+	record, err := s.CommitLog.Read(offset)
+	if err != nil {
+		return nil, err
+	}
+	if !inTopic(record, topic) {
+		return nil, notInTopic(offset, topic)
 	}
-}
\ No newline at end of file
+	return record, nil
+}
+
+// requestTopicは、topicのクエリパラメータかボディで指定したトピックを返す
+// トピックを省略した場合は、gRPCと同じくログ全体を対象にする
+func requestTopic(r *http.Request, body string) (string, error) {
+	query := r.URL.Query().Get("topic")
+	if query != "" && body != "" && query != body {
+		return "", fmt.Errorf("topic %q in query does not match topic %q in body", query, body)
+	}
+	if query != "" {
+		return query, nil
+	}
+	return body, nil
+}
+
+// queryAcksは、acksのクエリパラメータ(buffered、leader、all)を読む
+// 省略した場合は、gRPCと同じくACKS_BUFFEREDにする
+func queryAcks(r *http.Request) (api.Acks, error) {
+	v := r.URL.Query().Get("acks")
+	if v == "" {
+		return api.Acks_ACKS_BUFFERED, nil
+	}
+	acks, ok := api.Acks_value["ACKS_"+strings.ToUpper(v)]
+	if !ok {
+		return 0, fmt.Errorf("invalid acks: %q", v)
+	}
+	return api.Acks(acks), nil
+}
+
+// handleConsumeRecordは、パスで指定したオフセットのレコードを返す
+func (s *httpServer) handleConsumeRecord(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if err := s.authorize(r.Context(), object(topic), consumeAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), consumeAction, offsets) }()
+
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	if err := s.allowQuota(r.Context(), consumeAction, 0); err != nil {
+		httpError(w, err)
+		return
+	}
+	record, err := s.readRecord(offset, topic)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	s.chargeConsume(r.Context(), record)
+
+	switch negotiate(r) {
+	case contentTypeBytes:
+		offsets = offsetRange(offset, offset)
+		w.Header().Set("Content-Type", contentTypeBytes)
+		w.Header().Set(offsetHeader, strconv.FormatUint(record.Offset, 10))
+		w.Write(record.Value)
+	case contentTypeJSON:
+		offsets = offsetRange(offset, offset)
+		writeJSON(w, http.StatusOK, ConsumeResponse{Record: record})
+	default:
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+	}
+}
+
+// lowestOffsetterは、最も古いレコードのオフセットを返せるCommitLog
+type lowestOffsetter interface {
+	LowestOffset() (uint64, error)
+}
+
+// handleListRecordsは、fromのオフセットから最大limit件のレコードを返す
+func (s *httpServer) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if err := s.authorize(r.Context(), object(topic), consumeAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), consumeAction, offsets) }()
+
+	if negotiate(r) != contentTypeJSON {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	from, err := queryUint(r, "from", 0)
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryUint(r, "limit", defaultListLimit)
+	if err != nil || limit == 0 || limit > maxListLimit {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.allowQuota(r.Context(), consumeAction, 0); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	// 切り詰められたオフセットから読むと空のまま進まないため、最も古いレコードから読む
+	if l, ok := s.CommitLog.(lowestOffsetter); ok {
+		lowest, err := l.LowestOffset()
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if from < lowest {
+			from = lowest
+		}
+	}
+
+	// 他のトピックのレコードは読み飛ばす。読み飛ばしてもNextは進むので、
+	// Recordsが空でもNextから続きを読める
+	res := ListRecordsResponse{Records: []*api.Record{}, Next: from}
+	for scanned := 0; uint64(len(res.Records)) < limit && scanned < maxListScan; scanned++ {
+		record, err := s.CommitLog.Read(res.Next)
+		var outOfRange api.ErrOffsetOutOfRange
+		if errors.As(err, &outOfRange) {
+			break
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if !inTopic(record, topic) {
+			res.Next++
+			continue
+		}
+		res.Records = append(res.Records, record)
+		offsets = extend(offsets, res.Next)
+		res.Next++
+	}
+	s.chargeConsume(r.Context(), res.Records...)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// negotiateは、Acceptヘッダから応答に使うContent-Typeを決める
+// 対応する型がない場合は空文字を返す
+func negotiate(r *http.Request) string {
+	if r.Header.Get("Accept") == "" {
+		return contentTypeJSON
+	}
+	for _, mediaType := range acceptedTypes(r) {
+		switch mediaType {
+		case contentTypeJSON, "application/*", "*/*":
+			return contentTypeJSON
+		case contentTypeBytes:
+			return contentTypeBytes
+		}
+	}
+	return ""
+}
+
+// acceptedTypesは、Acceptヘッダに書かれた順にメディアタイプを返す
+func acceptedTypes(r *http.Request) []string {
+	var types []string
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		types = append(types, mediaType)
+	}
+	return types
+}
+
+func queryUint(r *http.Request, key string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+	// ヘッダを送った後なので、エンコードに失敗してもステータスコードは変えられない
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// authenticateは、gRPCと同じAuthenticatorでリクエストを認証し、
+// subjectをリクエストのコンテキストに入れる
+func (s *httpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// gRPCと同じく、クライアントのアドレスとTLSの状態をpeerとして渡す
+		p := &peer.Peer{Addr: httpAddr(r.RemoteAddr)}
+		if r.TLS != nil {
+			p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+		}
+		ctx := peer.NewContext(r.Context(), p)
+		// ベアラートークンとAPIキーは、gRPCのメタデータと同じ名前のヘッダで受け取る
+		md := metadata.MD{}
+		for _, key := range []string{"authorization", apiKeyMetadataKey} {
+			if values := r.Header.Values(key); len(values) > 0 {
+				md.Append(key, values...)
+			}
+		}
+		ctx, err := authenticate(metadata.NewIncomingContext(ctx, md), s.Authenticators)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// httpAddrは、HTTPのクライアントのアドレスをnet.Addrとして扱う
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// httpErrorは、ログとgRPCのエラーをHTTPのステータスコードに変換して返す
+func httpError(w http.ResponseWriter, err error) {
+	var outOfRange api.ErrOffsetOutOfRange
+	if errors.As(err, &outOfRange) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	code := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		code = http.StatusBadRequest
+	case codes.ResourceExhausted:
+		code = http.StatusTooManyRequests
+		if wait, ok := retryAfter(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		code = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// retryAfterは、クォータのエラーに付けたRetryInfoから再試行までの待ち時間を返す
+func retryAfter(err error) (time.Duration, bool) {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
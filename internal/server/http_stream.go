@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+const (
+	contentTypeEventStream = "text/event-stream"
+	contentTypeNDJSON      = "application/x-ndjson"
+)
+
+var (
+	// streamPollIntervalは、ログの末尾に追いついたときに新しいレコードを待つ間隔
+	streamPollInterval = 100 * time.Millisecond
+	// streamKeepAliveは、プロキシに接続を切られないようにコメントを送る間隔
+	streamKeepAlive = 15 * time.Second
+)
+
+// handleStreamRecordsは、fromのオフセットからログを追いかけて、レコードを
+// Server-Sent Eventsか改行区切りのJSONで送り続ける
+// SSEの再接続時は、Last-Event-IDの次のオフセットから再開する
+// topicを指定した場合は、他のトピックのレコードを読み飛ばす
+func (s *httpServer) handleStreamRecords(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if err := s.authorize(r.Context(), object(topic), consumeAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), consumeAction, offsets) }()
+
+	finish, ok := s.startStream()
+	if !ok {
+		httpError(w, errDraining)
+		return
+	}
+	defer finish()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	offset, err := streamOffset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// ConsumeStreamと同じく、ストリームの開始をリクエストとして数える
+	if err := s.allowQuota(r.Context(), consumeAction, 0); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	contentType := contentTypeEventStream
+	if negotiateStream(r) == contentTypeNDJSON {
+		contentType = contentTypeNDJSON
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		record, next, err := s.readFrom(offset)
+		offset = next
+		if err == nil && !inTopic(record, topic) {
+			offset++
+			continue
+		}
+		// ストリームの途中でポリシーが変わることがあるので、送るレコードごとに認可する
+		if err == nil {
+			err = s.authorize(r.Context(), object(topic), consumeAction)
+		}
+		if err == nil {
+			err = s.allowConsumeRecord(r.Context(), record)
+		}
+		var outOfRange api.ErrOffsetOutOfRange
+		switch {
+		case err == nil:
+			if err := writeStreamRecord(w, contentType, record); err != nil {
+				return
+			}
+			flusher.Flush()
+			// 監査ログには、終了時に送った範囲をまとめて記録する
+			offsets = extend(offsets, offset)
+			offset++
+			continue
+		case errors.As(err, &outOfRange):
+		default:
+			// ヘッダを送った後なので、SSEのイベントとしてエラーを伝えて終了する
+			if contentType == contentTypeEventStream {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+				flusher.Flush()
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.draining():
+			// クライアントはLast-Event-IDで別のノードか再起動後のノードに再接続する
+			return
+		case <-keepAlive.C:
+			if contentType == contentTypeEventStream {
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case <-poll.C:
+		}
+	}
+}
+
+func writeStreamRecord(w http.ResponseWriter, contentType string, record *api.Record) error {
+	b, err := json.Marshal(ConsumeResponse{Record: record})
+	if err != nil {
+		return err
+	}
+	if contentType == contentTypeNDJSON {
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", record.Offset, b)
+	return err
+}
+
+// streamOffsetは、Last-Event-IDかfromのクエリパラメータから読み始めるオフセットを決める
+func streamOffset(r *http.Request) (uint64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID: %q", id)
+		}
+		return last + 1, nil
+	}
+	from, err := queryUint(r, "from", 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid from: %q", r.URL.Query().Get("from"))
+	}
+	return from, nil
+}
+
+func negotiateStream(r *http.Request) string {
+	for _, mediaType := range acceptedTypes(r) {
+		switch mediaType {
+		case contentTypeNDJSON, contentTypeEventStream:
+			return mediaType
+		}
+	}
+	return contentTypeEventStream
+}
@@ -0,0 +1,791 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/auth"
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/log"
+)
+
+func TestHTTPServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		srv *httptest.Server,
+		rootClient *http.Client,
+		nobodyClient *http.Client,
+		config *Config,
+	){
+		"produce/consume a record over http succeeds":   testHTTPProduceConsume,
+		"consume past log boundary is not found":        testHTTPConsumePastBoundary,
+		"unauthorized is forbidden":                     testHTTPUnauthorized,
+		"produce/consume a record by resource succeeds": testHTTPRecordResource,
+		"list records from an offset succeeds":          testHTTPListRecords,
+		"stream records as server-sent events":          testHTTPStreamSSE,
+		"stream records as newline-delimited json":      testHTTPStreamNDJSON,
+		"streams skip truncated records":                testHTTPStreamTruncated,
+		"produce/consume over websocket succeeds":       testWebSocketProduceConsume,
+		"unauthorized websocket is forbidden":           testWebSocketUnauthorized,
+		"api key header authenticates over http":        testHTTPAPIKey,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			srv, rootClient, nobodyClient, cfg := setupHTTPTest(t, nil)
+			defer srv.Close()
+			fn(t, srv, rootClient, nobodyClient, cfg)
+		})
+	}
+}
+
+func TestHTTPStreamsDrain(t *testing.T) {
+	srv, client, _, cfg := setupHTTPTest(t, func(c *Config) {
+		c.Drainer = NewDrainer()
+	})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/records/stream", nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	consume, wsRes, err := dialWebSocket(t, srv, client, "/records/ws/consume")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer consume.Close()
+	produce, wsRes, err := dialWebSocket(t, srv, client, "/records/ws/produce")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer produce.Close()
+
+	// ドレインに入ると、実行中のストリームが全て終わってからWaitが返る
+	cfg.Drainer.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, cfg.Drainer.Wait(ctx))
+
+	_, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var wsErr WebSocketError
+	require.NoError(t, consume.ReadJSON(&wsErr))
+	require.Equal(t, "server is draining", wsErr.Error)
+	_, _, err = consume.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart))
+	_, _, err = produce.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart))
+
+	// ドレイン中の新しいストリームは拒否する
+	res, err = client.Get(srv.URL + "/records/stream")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	_, wsRes, err = dialWebSocket(t, srv, client, "/records/ws/produce")
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	wsRes.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, wsRes.StatusCode)
+}
+
+// HTTPとWebSocketの書き込みが、gRPCと同じくリーダーへの転送、トピック、acksを扱うことを確認する
+func TestHTTPProduceForwardedToLeader(t *testing.T) {
+	leaderAddr, leaderCfg, _, teardownLeader := setupTest(t, func(c *Config) {
+		c.LeaderFinder = &leaderFinder{local: true}
+		c.TrustedForwarders = []string{"node"}
+	})
+	defer teardownLeader()
+
+	forwardOpts := testDialOptions(t,
+		config.NodeClientCertFile,
+		config.NodeClientKeyFile,
+	)
+	srv, client, _, cfg := setupHTTPTest(t, func(c *Config) {
+		c.LeaderFinder = &leaderFinder{addr: leaderAddr}
+		c.ForwardDialOptions = forwardOpts
+	})
+	defer srv.Close()
+
+	// クライアントが付けたトピックは、リクエストのトピックで上書きする
+	res := doJSON(t, client, http.MethodPost, srv.URL+"/records?acks=leader", ProduceRequest{
+		Record: &api.Record{Value: []byte("hello"), Topic: "other"},
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var produce ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&produce))
+	record, err := leaderCfg.CommitLog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), record.Value)
+	require.Equal(t, "", record.Topic)
+	_, err = cfg.CommitLog.Read(produce.Offset)
+	require.Error(t, err)
+
+	conn, wsRes, err := dialWebSocket(t, srv, client, "/records/ws/produce")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(ProduceRequest{Record: &api.Record{Value: []byte("world")}}))
+	var ack ProduceResponse
+	require.NoError(t, conn.ReadJSON(&ack))
+	require.Equal(t, produce.Offset+1, ack.Offset)
+	record, err = leaderCfg.CommitLog.Read(ack.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), record.Value)
+
+	// リーダーはレプリケーションを設定していないので、ACKS_ALLを満たせない
+	res = doJSON(t, client, http.MethodPost, srv.URL+"/records?acks=all", ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = doJSON(t, client, http.MethodPost, srv.URL+"/records?acks=maybe", ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHTTPTopicScopedACL(t *testing.T) {
+	// nobodyは、ordersに書き込めるがevents.*からしか読み出せない
+	policy, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policy.Name())
+	_, err = policy.WriteString(`p, root, *, produce
+p, root, *, consume
+p, nobody, orders, produce
+p, nobody, events.*, consume
+`)
+	require.NoError(t, err)
+	require.NoError(t, policy.Close())
+
+	srv, root, nobody, cfg := setupHTTPTest(t, func(c *Config) {
+		c.Authorizer = auth.New(config.ACLModelFile, policy.Name())
+	})
+	defer srv.Close()
+
+	produce := func(client *http.Client, topic string) *http.Response {
+		return doJSON(t, client, http.MethodPost, srv.URL+"/records?topic="+topic, ProduceRequest{
+			Record: &api.Record{Value: []byte(topic)},
+		})
+	}
+	require.Equal(t, http.StatusCreated, produce(nobody, "orders").StatusCode)
+	require.Equal(t, http.StatusForbidden, produce(nobody, "events.clicks").StatusCode)
+	// トピックがない場合はログ全体への権限が必要
+	require.Equal(t, http.StatusForbidden, produce(nobody, "").StatusCode)
+	require.Equal(t, http.StatusCreated, produce(root, "events.clicks").StatusCode)
+	record, err := cfg.CommitLog.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "events.clicks", record.Topic)
+
+	// ボディでもトピックを指定できるが、クエリパラメータと食い違う場合は拒否する
+	res := doJSON(t, nobody, http.MethodPost, srv.URL+"/", ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{Value: []byte("orders")},
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = doJSON(t, nobody, http.MethodPost, srv.URL+"/records?topic=orders", ProduceRequest{
+		Topic:  "events.clicks",
+		Record: &api.Record{Value: []byte("orders")},
+	})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = do(t, nobody, http.MethodGet, srv.URL+"/records/1?topic=events.clicks", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	// 他のトピックのレコードは読み出せない
+	res = do(t, nobody, http.MethodGet, srv.URL+"/records/0?topic=events.clicks", nil, nil)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(t, nobody, http.MethodGet, srv.URL+"/records/1", nil, nil)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res = do(t, nobody, http.MethodGet, srv.URL+"/records/0?topic=orders", nil, nil)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = do(t, nobody, http.MethodGet, srv.URL+"/records?topic=events.clicks", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var list ListRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Records, 1)
+	require.Equal(t, uint64(1), list.Records[0].Offset)
+	require.Equal(t, uint64(3), list.Next)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream?topic=events.clicks", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", contentTypeNDJSON)
+	res, err = nobody.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var consume ConsumeResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&consume))
+	require.Equal(t, uint64(1), consume.Record.Offset)
+
+	conn, wsRes, err := dialWebSocket(t, srv, nobody, "/records/ws/consume?topic=events.clicks")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.ReadJSON(&consume))
+	require.Equal(t, uint64(1), consume.Record.Offset)
+
+	_, wsRes, err = dialWebSocket(t, srv, nobody, "/records/ws/produce")
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	wsRes.Body.Close()
+	require.Equal(t, http.StatusForbidden, wsRes.StatusCode)
+	conn, wsRes, err = dialWebSocket(t, srv, nobody, "/records/ws/produce?topic=orders")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(ProduceRequest{Record: &api.Record{Value: []byte("orders")}}))
+	var ack ProduceResponse
+	require.NoError(t, conn.ReadJSON(&ack))
+	record, err = cfg.CommitLog.Read(ack.Offset)
+	require.NoError(t, err)
+	require.Equal(t, "orders", record.Topic)
+}
+
+// ストリームの途中で読み出しの権限を取り消すと、次のレコードを送らずに終わることを確認する
+func TestHTTPStreamsReauthorize(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	write := func(rules string) {
+		require.NoError(t, os.WriteFile(policy, []byte("p, root, *, produce\n"+rules), 0600))
+	}
+	write("p, nobody, *, consume\n")
+	authorizer := auth.New(config.ACLModelFile, policy)
+	srv, _, nobody, cfg := setupHTTPTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer srv.Close()
+	_, err := cfg.CommitLog.Append(&api.Record{Value: []byte("allowed")})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/records/stream", nil)
+	require.NoError(t, err)
+	res, err := nobody.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	events := bufio.NewReader(res.Body)
+	_, consume := readEvent(t, events)
+	require.Equal(t, []byte("allowed"), consume.Record.Value)
+
+	conn, wsRes, err := dialWebSocket(t, srv, nobody, "/records/ws/consume")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.ReadJSON(&consume))
+	require.Equal(t, []byte("allowed"), consume.Record.Value)
+
+	write("")
+	require.NoError(t, authorizer.Reload())
+	_, err = cfg.CommitLog.Append(&api.Record{Value: []byte("denied")})
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(events)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "event: error\n")
+	require.NotContains(t, string(b), "id: 1\n")
+
+	var wsErr WebSocketError
+	require.NoError(t, conn.ReadJSON(&wsErr))
+	require.Contains(t, wsErr.Error, "not permitted")
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+func TestHTTPQuotas(t *testing.T) {
+	srv, client, _, _ := setupHTTPTest(t, func(c *Config) {
+		c.Quotas = NewQuotas(QuotaConfig{
+			Default: QuotaLimits{
+				ProduceRequestsPerSecond: 1,
+				ConsumeRequestsPerSecond: 1,
+			},
+		})
+	})
+	defer srv.Close()
+
+	res := doJSON(t, client, http.MethodPost, srv.URL+"/records", ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	res = doJSON(t, client, http.MethodPost, srv.URL+"/records", ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Retry-After"))
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/0", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = do(t, client, http.MethodGet, srv.URL+"/records?from=0", nil, nil)
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	// WebSocketの書き込みも同じsubjectのクォータで拒否する
+	conn, wsRes, err := dialWebSocket(t, srv, client, "/records/ws/produce")
+	require.NoError(t, err)
+	defer wsRes.Body.Close()
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(ProduceRequest{Record: &api.Record{Value: []byte("world")}}))
+	var wsErr WebSocketError
+	require.NoError(t, conn.ReadJSON(&wsErr))
+	require.Contains(t, wsErr.Error, "quota exceeded")
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater))
+}
+
+func setupHTTPTest(t *testing.T, fn func(*Config)) (
+	srv *httptest.Server,
+	rootClient *http.Client,
+	nobodyClient *http.Client,
+	cfg *Config,
+) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "http-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { clog.Remove() })
+
+	cfg = &Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+
+	srv = httptest.NewUnstartedServer(NewHTTPServer("", cfg).Handler)
+	srv.TLS = serverTLSConfig
+	srv.StartTLS()
+
+	newClient := func(certPath, keyPath string) *http.Client {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CAFile:   config.CAFile,
+			CertFile: certPath,
+			KeyFile:  keyPath,
+		})
+		require.NoError(t, err)
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+	rootClient = newClient(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyClient = newClient(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	return srv, rootClient, nobodyClient, cfg
+}
+
+func testHTTPProduceConsume(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	want := []byte("hello world")
+	res := doJSON(t, client, http.MethodPost, srv.URL, ProduceRequest{
+		Record: &api.Record{Value: want},
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var produce ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&produce))
+
+	// HTTPで書き込んだレコードは、gRPCと同じコミットログから読める
+	record, err := config.CommitLog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, want, record.Value)
+
+	res = doJSON(t, client, http.MethodGet, srv.URL, ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var consume ConsumeResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&consume))
+	require.Equal(t, want, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+}
+
+func testHTTPConsumePastBoundary(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	res := doJSON(t, client, http.MethodGet, srv.URL, ConsumeRequest{
+		Offset: 1,
+	})
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func testHTTPUnauthorized(
+	t *testing.T,
+	srv *httptest.Server,
+	_, client *http.Client,
+	config *Config,
+) {
+	res := doJSON(t, client, http.MethodPost, srv.URL, ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res = doJSON(t, client, http.MethodGet, srv.URL, ConsumeRequest{})
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func testHTTPRecordResource(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	res := doJSON(t, client, http.MethodPost, srv.URL+"/records", ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, client, http.MethodPost, srv.URL+"/records", map[string]string{
+		"Content-Type": "application/octet-stream",
+	}, []byte("second"))
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var produce ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&produce))
+	require.Equal(t, uint64(1), produce.Offset)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/0", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var consume ConsumeResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&consume))
+	require.Equal(t, []byte("first"), consume.Record.Value)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/1", map[string]string{
+		"Accept": "application/octet-stream",
+	}, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Proglog-Offset"))
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), b)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/2", nil, nil)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/0", map[string]string{
+		"Accept": "text/html",
+	}, nil)
+	require.Equal(t, http.StatusNotAcceptable, res.StatusCode)
+}
+
+func testHTTPListRecords(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	for i := 0; i < 5; i++ {
+		_, err := config.CommitLog.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	res := do(t, client, http.MethodGet, srv.URL+"/records?from=1&limit=3", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var list ListRecordsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Records, 3)
+	require.Equal(t, []byte("record 1"), list.Records[0].Value)
+	require.Equal(t, uint64(4), list.Next)
+
+	// 末尾を越えた分は返さない
+	res = do(t, client, http.MethodGet, srv.URL+"/records?from=4", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	list = ListRecordsResponse{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Records, 1)
+	require.Equal(t, uint64(5), list.Next)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records?limit=0", nil, nil)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// 切り詰めた範囲からは、残っている最も古いレコードから返す
+	clog := config.CommitLog.(*log.Log)
+	_, err := clog.Roll()
+	require.NoError(t, err)
+	require.NoError(t, clog.Truncate(4))
+	_, err = clog.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	res = do(t, client, http.MethodGet, srv.URL+"/records?from=0", nil, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	list = ListRecordsResponse{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Records, 1)
+	require.Equal(t, uint64(5), list.Records[0].Offset)
+	require.Equal(t, uint64(6), list.Next)
+}
+
+func testHTTPStreamSSE(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream", nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// 接続した後に書き込まれたレコードも送られてくる
+	for i := 0; i < 2; i++ {
+		_, err := config.CommitLog.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	events := bufio.NewReader(res.Body)
+	for i := 0; i < 2; i++ {
+		id, consume := readEvent(t, events)
+		require.Equal(t, fmt.Sprintf("%d", i), id)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), consume.Record.Value)
+	}
+	cancel()
+
+	// Last-Event-IDで再接続すると、その次のオフセットから再開する
+	req, err = http.NewRequest(http.MethodGet, srv.URL+"/records/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	res, err = client.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	id, consume := readEvent(t, bufio.NewReader(res.Body))
+	require.Equal(t, "1", id)
+	require.Equal(t, []byte("record 1"), consume.Record.Value)
+}
+
+func testHTTPStreamNDJSON(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	for i := 0; i < 3; i++ {
+		_, err := config.CommitLog.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream?from=1", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+	dec := json.NewDecoder(res.Body)
+	for i := 1; i < 3; i++ {
+		var consume ConsumeResponse
+		require.NoError(t, dec.Decode(&consume))
+		require.Equal(t, uint64(i), consume.Record.Offset)
+	}
+}
+
+func testWebSocketProduceConsume(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	produce, res, err := dialWebSocket(t, srv, client, "/records/ws/produce")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	defer produce.Close()
+
+	consume, res, err := dialWebSocket(t, srv, client, "/records/ws/consume?from=0")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	defer consume.Close()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, produce.WriteJSON(ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		}))
+		var ack ProduceResponse
+		require.NoError(t, produce.ReadJSON(&ack))
+		require.Equal(t, uint64(i), ack.Offset)
+	}
+
+	for i := 0; i < 2; i++ {
+		var res ConsumeResponse
+		require.NoError(t, consume.ReadJSON(&res))
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+
+	// 不正なフレームを送るとエラーを返して接続を閉じる
+	require.NoError(t, produce.WriteMessage(websocket.TextMessage, []byte("{}")))
+	var wsErr WebSocketError
+	require.NoError(t, produce.ReadJSON(&wsErr))
+	require.Equal(t, "record is required", wsErr.Error)
+	_, _, err = produce.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseUnsupportedData))
+}
+
+func testWebSocketUnauthorized(
+	t *testing.T,
+	srv *httptest.Server,
+	_, client *http.Client,
+	config *Config,
+) {
+	for _, path := range []string{
+		"/records/ws/produce",
+		"/records/ws/consume",
+	} {
+		_, res, err := dialWebSocket(t, srv, client, path)
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		require.Equal(t, http.StatusForbidden, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func dialWebSocket(
+	t *testing.T,
+	srv *httptest.Server,
+	client *http.Client,
+	path string,
+) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{
+		TLSClientConfig: client.Transport.(*http.Transport).TLSClientConfig,
+	}
+	url := "wss" + strings.TrimPrefix(srv.URL, "https") + path
+	return dialer.Dial(url, nil)
+}
+
+// 切り詰めた範囲から読み始めても、SSEとWebSocketは残っている最も古いレコードから送る
+func testHTTPStreamTruncated(
+	t *testing.T,
+	srv *httptest.Server,
+	client, _ *http.Client,
+	config *Config,
+) {
+	truncateLog(t, config.CommitLog.(*log.Log), 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream?from=0", nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	id, consume := readEvent(t, bufio.NewReader(res.Body))
+	require.Equal(t, "3", id)
+	require.Equal(t, []byte("after truncate"), consume.Record.Value)
+
+	conn, _, err := dialWebSocket(t, srv, client, "/records/ws/consume?from=0")
+	require.NoError(t, err)
+	defer conn.Close()
+	var frame ConsumeResponse
+	require.NoError(t, conn.ReadJSON(&frame))
+	require.Equal(t, uint64(3), frame.Record.Offset)
+}
+
+// readEventは、SSEのイベントを一つ読んでIDとデータを返す
+func readEvent(t *testing.T, r *bufio.Reader) (string, ConsumeResponse) {
+	t.Helper()
+	var id string
+	var consume ConsumeResponse
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return id, consume
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			require.NoError(t, json.Unmarshal([]byte(data), &consume))
+		}
+	}
+}
+
+func testHTTPAPIKey(
+	t *testing.T,
+	srv *httptest.Server,
+	_, client *http.Client,
+	config *Config,
+) {
+	config.Authenticators = []Authenticator{
+		NewAPIKeyAuthenticator(map[string]string{"root-key": "root"}),
+		TLSAuthenticator{},
+	}
+
+	// nobodyの証明書で接続しても、APIキーのsubjectで認可する
+	res := do(t, client, http.MethodPost, srv.URL+"/records", map[string]string{
+		"Content-Type": "application/octet-stream",
+		"X-Api-Key":    "root-key",
+	}, []byte("hello"))
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(t, client, http.MethodGet, srv.URL+"/records/0", map[string]string{
+		"X-Api-Key": "wrong",
+	}, nil)
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func doJSON(
+	t *testing.T,
+	client *http.Client,
+	method, url string,
+	body interface{},
+) *http.Response {
+	t.Helper()
+	b, err := json.Marshal(body)
+	require.NoError(t, err)
+	return do(t, client, method, url, nil, b)
+}
+
+func do(
+	t *testing.T,
+	client *http.Client,
+	method, url string,
+	header map[string]string,
+	body []byte,
+) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// websocketWriteWaitは、フレームの書き込みを待つ時間
+const websocketWriteWait = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WebSocketErrorは、WebSocketで処理に失敗したときに送るフレーム
+type WebSocketError struct {
+	Error string `json:"error"`
+}
+
+// handleProduceWebSocketは、ProduceStreamと同じく、ProduceRequestのフレームを
+// 受け取るたびにログに書き込み、オフセットをProduceResponseのフレームで返す
+// トピックはtopicのクエリパラメータか、フレームごとにProduceRequestのTopicで指定する
+func (s *httpServer) handleProduceWebSocket(w http.ResponseWriter, r *http.Request) {
+	connTopic := r.URL.Query().Get("topic")
+	if err := s.authorize(r.Context(), object(connTopic), produceAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	// 接続の許可は記録せず、書き込んだフレームごとに範囲を記録する
+
+	acks, err := queryAcks(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	finish, ok := s.startStream()
+	if !ok {
+		httpError(w, errDraining)
+		return
+	}
+	defer finish()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgradeがクライアントにエラーを返している
+		return
+	}
+	defer conn.Close()
+
+	// 次のフレームを待っている間にドレインに入ったら、接続を閉じて受信を終わらせる
+	// WriteControlとCloseは、他の読み書きと並行して呼べる
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.draining():
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, status.Convert(errDraining).Message()),
+				time.Now().Add(websocketWriteWait),
+			)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var req ProduceRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				closeWebSocket(conn, websocket.CloseUnsupportedData, err)
+			}
+			return
+		}
+		if req.Record == nil {
+			closeWebSocket(conn, websocket.CloseUnsupportedData, errors.New("record is required"))
+			return
+		}
+		topic, err := requestTopic(r, req.Topic)
+		if err != nil {
+			closeWebSocket(conn, websocket.CloseUnsupportedData, err)
+			return
+		}
+		// gRPCのProduceと同じく、書き込みごとに認可する
+		if err := s.authorize(r.Context(), object(topic), produceAction); err != nil {
+			closeWebSocket(conn, websocket.ClosePolicyViolation, err)
+			return
+		}
+		res, err := s.produceRecord(r.Context(), topic, req.Record, acks)
+		if err != nil {
+			s.auditAllowed(r.Context(), object(topic), produceAction, nil)
+			closeWebSocket(conn, websocketCloseCode(err), err)
+			return
+		}
+		s.auditAllowed(r.Context(), object(topic), produceAction, offsetRange(res.Offset, res.Offset))
+		if err := writeWebSocketJSON(conn, ProduceResponse{Offset: res.Offset}); err != nil {
+			return
+		}
+	}
+}
+
+// handleConsumeWebSocketは、ConsumeStreamと同じく、fromのオフセットからログを
+// 追いかけてConsumeResponseのフレームを送り続ける
+// topicを指定した場合は、他のトピックのレコードを読み飛ばす
+func (s *httpServer) handleConsumeWebSocket(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if err := s.authorize(r.Context(), object(topic), consumeAction); err != nil {
+		httpError(w, err)
+		return
+	}
+	var offsets *api.OffsetRange
+	defer func() { s.auditAllowed(r.Context(), object(topic), consumeAction, offsets) }()
+
+	offset, err := queryUint(r, "from", 0)
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	if err := s.allowQuota(r.Context(), consumeAction, 0); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	finish, ok := s.startStream()
+	if !ok {
+		httpError(w, errDraining)
+		return
+	}
+	defer finish()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// クライアントが接続を閉じたことを知るために、受信を続ける
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+	for {
+		record, next, err := s.readFrom(offset)
+		offset = next
+		if err == nil && !inTopic(record, topic) {
+			offset++
+			continue
+		}
+		// ストリームの途中でポリシーが変わることがあるので、送るレコードごとに認可する
+		if err == nil {
+			err = s.authorize(ctx, object(topic), consumeAction)
+		}
+		if err == nil {
+			err = s.allowConsumeRecord(ctx, record)
+		}
+		var outOfRange api.ErrOffsetOutOfRange
+		switch {
+		case err == nil:
+			if err := writeWebSocketJSON(conn, ConsumeResponse{Record: record}); err != nil {
+				return
+			}
+			offsets = extend(offsets, offset)
+			offset++
+			continue
+		case errors.As(err, &outOfRange):
+		default:
+			closeWebSocket(conn, websocketCloseCode(err), err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.draining():
+			closeWebSocket(conn, websocket.CloseServiceRestart, errDraining)
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+func writeWebSocketJSON(conn *websocket.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+	return conn.WriteJSON(v)
+}
+
+// closeWebSocketは、エラーを伝えるフレームを送ってから接続を閉じる
+func closeWebSocket(conn *websocket.Conn, code int, err error) {
+	msg := err.Error()
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		msg = st.Message()
+	}
+	_ = writeWebSocketJSON(conn, WebSocketError{Error: msg})
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, truncateCloseReason(msg)),
+		time.Now().Add(websocketWriteWait),
+	)
+}
+
+// websocketCloseCodeは、エラーをクローズフレームのステータスコードに変換する
+func websocketCloseCode(err error) int {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return websocket.ClosePolicyViolation
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return websocket.CloseUnsupportedData
+	case codes.ResourceExhausted:
+		return websocket.CloseTryAgainLater
+	case codes.Unavailable:
+		return websocket.CloseServiceRestart
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// クローズフレームの理由は123バイトまでしか送れない
+func truncateCloseReason(msg string) string {
+	if len(msg) > 123 {
+		return msg[:123]
+	}
+	return msg
+}
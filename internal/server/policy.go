@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/tukki0210/proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// PolicyEventNameは、ポリシーの変更を他のノードに伝えるユーザーイベントの名前
+	PolicyEventName = "proglog-policy"
+	// PolicySnapshotQueryNameは、他のノードのポリシーの全体を問い合わせるクエリの名前
+	PolicySnapshotQueryName = "proglog-policy-snapshot"
+)
+
+// PolicyManagerは、ACLのポリシーを変更して永続化する
+type PolicyManager interface {
+	AddPolicy(subject, object, action string) (bool, error)
+	RemovePolicy(subject, object, action string) (bool, error)
+	Policies() [][]string
+}
+
+// Broadcasterは、ペイロードをクラスタの全てのノードに送る
+// discovery.Membershipがこのインターフェースを満たす
+type Broadcaster interface {
+	Broadcast(name string, payload []byte) error
+}
+
+// policyChangeは、ユーザーイベントで送るポリシーの変更
+type policyChange struct {
+	Remove  bool   `json:"remove,omitempty"`
+	Subject string `json:"subject"`
+	Object  string `json:"object"`
+	Action  string `json:"action"`
+}
+
+// invalidPolicyCharsは、policy.csvの区切りや行を壊すため、ルールに使えない文字
+const invalidPolicyChars = ",\"\r\n"
+
+// validateは、policy.csvに保存できるルールかを確かめる
+// 改行を許すと、変更を送れる利用者が別のルールを書き込めてしまう
+func (c policyChange) validate() error {
+	for _, field := range []string{c.Subject, c.Object, c.Action} {
+		if field == "" {
+			return status.Error(
+				codes.InvalidArgument,
+				"policy requires subject, object and action",
+			)
+		}
+		if strings.ContainsAny(field, invalidPolicyChars) {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"policy field %q must not contain commas, quotes or line breaks",
+				field,
+			)
+		}
+	}
+	return nil
+}
+
+func (c policyChange) apply(m PolicyManager) (bool, error) {
+	if c.Remove {
+		return m.RemovePolicy(c.Subject, c.Object, c.Action)
+	}
+	return m.AddPolicy(c.Subject, c.Object, c.Action)
+}
+
+// policyRuleは、変更の対象となるルール
+type policyRule struct {
+	Subject string
+	Object  string
+	Action  string
+}
+
+// policyVersionは、ルールに最後に適用した変更
+type policyVersion struct {
+	LTime  uint64
+	Remove bool
+}
+
+// newerは、ltimeの変更がvより新しいかを返す
+// 同じLamport時刻の変更が競合した場合は、権限を残さないように削除を優先する
+func (v policyVersion) newer(ltime uint64, remove bool) bool {
+	if ltime != v.LTime {
+		return ltime > v.LTime
+	}
+	return remove && !v.Remove
+}
+
+// policySnapshotEntryは、スナップショットで送るルールとその最後の変更
+type policySnapshotEntry struct {
+	policyChange
+	LTime uint64 `json:"ltime"`
+}
+
+// PolicyReplicaは、他のノードから届いたポリシーの変更を、ルールごとに最も新しい
+// Lamport時刻の変更だけが残るように適用する
+// ユーザーイベントが届く順序や、スナップショットとの前後に関わらず同じポリシーに収束する
+// ユーザーイベントとクエリは認証されないので、ゴシップを暗号化している場合だけ使う
+type PolicyReplica struct {
+	manager PolicyManager
+	logger  *zap.Logger
+
+	mu sync.Mutex
+	// versionsは、メモリにだけ持つ。再起動した場合は、他のノードのスナップショットで戻す
+	versions map[policyRule]policyVersion
+}
+
+func NewPolicyReplica(m PolicyManager) *PolicyReplica {
+	return &PolicyReplica{
+		manager:  m,
+		logger:   zap.L().Named("policy"),
+		versions: make(map[policyRule]policyVersion),
+	}
+}
+
+// HandleEventは、他のノードから届いたポリシーの変更を適用する
+// discovery.MembershipのRegisterEventHandlerにPolicyEventNameで登録する
+func (r *PolicyReplica) HandleEvent(ltime uint64, payload []byte) {
+	var c policyChange
+	if err := json.Unmarshal(payload, &c); err != nil {
+		r.logger.Error("failed to decode policy change", zap.Error(err))
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apply(c, ltime)
+}
+
+// applyは、ルールに適用した変更より新しい変更だけを適用する。r.muのロックを取って呼ぶ
+// 変更は冪等なので、自分が送ったイベントを受け取っても問題ない
+func (r *PolicyReplica) apply(c policyChange, ltime uint64) {
+	// 他のノードから届いた変更も、Admin APIと同じく保存できるルールか確かめる
+	if err := c.validate(); err != nil {
+		r.logger.Error("rejected policy change", zap.Error(err))
+		return
+	}
+	rule := policyRule{Subject: c.Subject, Object: c.Object, Action: c.Action}
+	if v, ok := r.versions[rule]; ok && !v.newer(ltime, c.Remove) {
+		return
+	}
+	if _, err := c.apply(r.manager); err != nil {
+		r.logger.Error(
+			"failed to apply policy change",
+			zap.Error(err),
+			zap.String("subject", c.Subject),
+		)
+		return
+	}
+	r.versions[rule] = policyVersion{LTime: ltime, Remove: c.Remove}
+}
+
+// HandleSnapshotQueryは、このノードが適用したルールごとの最後の変更を返す
+// 削除したルールも返して、古い追加で復活しないようにする
+// discovery.MembershipのRegisterQueryHandlerにPolicySnapshotQueryNameで登録する
+func (r *PolicyReplica) HandleSnapshotQuery(payload []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]policySnapshotEntry, 0, len(r.versions))
+	for rule, v := range r.versions {
+		entries = append(entries, policySnapshotEntry{
+			policyChange: policyChange{
+				Remove:  v.Remove,
+				Subject: rule.Subject,
+				Object:  rule.Object,
+				Action:  rule.Action,
+			},
+			LTime: v.LTime,
+		})
+	}
+	return json.Marshal(entries)
+}
+
+// Mergeは、他のノードのスナップショットのうち、このノードより新しい変更を適用する
+func (r *PolicyReplica) Merge(snapshot []byte) error {
+	var entries []policySnapshotEntry
+	if err := json.Unmarshal(snapshot, &entries); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range entries {
+		r.apply(e.policyChange, e.LTime)
+	}
+	return nil
+}
+
+func (r *PolicyReplica) sync(s PolicySnapshotter) {
+	snapshots, err := s.PolicySnapshots()
+	if err != nil {
+		r.logger.Error("failed to query policy snapshots", zap.Error(err))
+		return
+	}
+	for _, snapshot := range snapshots {
+		if err := r.Merge(snapshot); err != nil {
+			r.logger.Error("failed to merge policy snapshot", zap.Error(err))
+		}
+	}
+}
+
+// PolicySnapshotterは、他のノードのポリシーのスナップショットを集める
+type PolicySnapshotter interface {
+	PolicySnapshots() ([][]byte, error)
+}
+
+// Watchは、すぐに一度と、その後intervalごとに他のノードのスナップショットを取り込む
+// ユーザーイベントを取りこぼしたノードや、後から参加したノードも同じポリシーに揃う
+// 返り値の関数で取り込みを止める
+func (r *PolicyReplica) Watch(s PolicySnapshotter, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			r.sync(s)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (s *adminServer) AddPolicy(ctx context.Context, req *api.AddPolicyRequest) (*api.AddPolicyResponse, error) {
+	changed, err := s.changePolicy(ctx, req.Policy, false)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddPolicyResponse{Added: changed}, nil
+}
+
+func (s *adminServer) RemovePolicy(ctx context.Context, req *api.RemovePolicyRequest) (*api.RemovePolicyResponse, error) {
+	changed, err := s.changePolicy(ctx, req.Policy, true)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemovePolicyResponse{Removed: changed}, nil
+}
+
+func (s *adminServer) ListPolicies(ctx context.Context, req *api.ListPoliciesRequest) (*api.ListPoliciesResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if s.PolicyManager == nil {
+		return nil, errPolicyNotConfigured
+	}
+	res := &api.ListPoliciesResponse{}
+	for _, rule := range s.PolicyManager.Policies() {
+		res.Policies = append(res.Policies, &api.Policy{
+			Subject: rule[0],
+			Object:  rule[1],
+			Action:  rule[2],
+		})
+	}
+	return res, nil
+}
+
+var errPolicyNotConfigured = status.Error(
+	codes.Unimplemented,
+	"policy management is not configured",
+)
+
+// changePolicyは、ポリシーをローカルで変更してから他のノードに伝える
+func (s *adminServer) changePolicy(ctx context.Context, p *api.Policy, remove bool) (bool, error) {
+	if err := s.authorize(ctx); err != nil {
+		return false, err
+	}
+	if s.PolicyManager == nil {
+		return false, errPolicyNotConfigured
+	}
+	c := policyChange{
+		Remove:  remove,
+		Subject: p.GetSubject(),
+		Object:  p.GetObject(),
+		Action:  p.GetAction(),
+	}
+	if err := c.validate(); err != nil {
+		return false, err
+	}
+	changed, err := c.apply(s.PolicyManager)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to change policy: %v", err)
+	}
+	if changed && s.PolicyBroadcaster != nil {
+		payload, err := json.Marshal(c)
+		if err != nil {
+			return false, err
+		}
+		if err := s.PolicyBroadcaster.Broadcast(PolicyEventName, payload); err != nil {
+			return false, status.Errorf(
+				codes.Unavailable,
+				"changed policy locally but failed to propagate: %v",
+				err,
+			)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// QuotaLimitsは、1つのsubjectに許可する1秒あたりのリクエスト数とバイト数
+// 0の項目は制限しない。1秒分をバーストとして許可する
+type QuotaLimits struct {
+	ProduceRequestsPerSecond float64
+	ProduceBytesPerSecond    float64
+	ConsumeRequestsPerSecond float64
+	ConsumeBytesPerSecond    float64
+}
+
+// QuotaConfigは、subjectごとのクォータの設定
+type QuotaConfig struct {
+	// Defaultは、Subjectsに含まれない全てのsubjectに適用する制限
+	Default QuotaLimits
+	// Subjectsは、subjectごとにDefaultを上書きする制限
+	Subjects map[string]QuotaLimits
+}
+
+// limiterIdleTimeoutの間使われなかったsubjectの制限は、次に使うときに作り直す
+// subjectの数だけ制限が溜まり続けないようにするため
+const limiterIdleTimeout = 10 * time.Minute
+
+// Quotasは、認証されたsubjectごとにProduceとConsumeの流量を制限する
+// 信頼できるノードから転送されたリクエストは、転送元のノードで制限済みなので数えない
+type Quotas struct {
+	config QuotaConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[string]*subjectLimiter
+	lastSweep time.Time
+}
+
+func NewQuotas(config QuotaConfig) *Quotas {
+	return &Quotas{
+		config:   config,
+		now:      time.Now,
+		limiters: make(map[string]*subjectLimiter),
+	}
+}
+
+type subjectLimiter struct {
+	lastUsed        time.Time
+	produceRequests *tokenBucket
+	produceBytes    *tokenBucket
+	consumeRequests *tokenBucket
+	consumeBytes    *tokenBucket
+}
+
+func (q *Quotas) limiter(subject string) *subjectLimiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.evictIdle(now)
+	l, ok := q.limiters[subject]
+	if !ok {
+		limits, ok := q.config.Subjects[subject]
+		if !ok {
+			limits = q.config.Default
+		}
+		l = &subjectLimiter{
+			produceRequests: newTokenBucket(limits.ProduceRequestsPerSecond, now),
+			produceBytes:    newTokenBucket(limits.ProduceBytesPerSecond, now),
+			consumeRequests: newTokenBucket(limits.ConsumeRequestsPerSecond, now),
+			consumeBytes:    newTokenBucket(limits.ConsumeBytesPerSecond, now),
+		}
+		q.limiters[subject] = l
+	}
+	l.lastUsed = now
+	return l
+}
+
+// evictIdleは、limiterIdleTimeoutの間使われていない制限を捨てる
+// 全体を走査するのはlimiterIdleTimeoutごとに1回だけにする
+func (q *Quotas) evictIdle(now time.Time) {
+	if now.Sub(q.lastSweep) < limiterIdleTimeout {
+		return
+	}
+	q.lastSweep = now
+	for subject, l := range q.limiters {
+		if now.Sub(l.lastUsed) >= limiterIdleTimeout {
+			delete(q.limiters, subject)
+		}
+	}
+}
+
+// takeは、バケットからnだけ取り出す。残りがない場合は取り出さずにエラーを返す
+// 1回で1秒分を超えるメッセージも通せるように、残りが1以上あれば許可して
+// 不足分は次の補充で返す
+func (q *Quotas) take(subject, kind string, b *tokenBucket, n float64) error {
+	wait, ok := b.take(q.now(), n)
+	if ok {
+		return nil
+	}
+	return quotaExceeded(subject, kind, wait)
+}
+
+// allowRequestは、リクエストの数とバイト数の両方に残りがある場合だけ許可する
+// 片方で拒否したリクエストで、もう片方の残りを減らさないようにする
+// Consumeのバイト数は応答を作るまで分からないため、残りがあるかだけを確認する
+func (q *Quotas) allowRequest(ctx context.Context, action string, bytes float64) error {
+	subject := subject(ctx)
+	l := q.limiter(subject)
+	requests, bytesBucket := l.consumeRequests, l.consumeBytes
+	if action == produceAction {
+		requests, bytesBucket = l.produceRequests, l.produceBytes
+	}
+	wait, exhausted := takeBoth(q.now(), requests, bytesBucket, bytes)
+	switch exhausted {
+	case nil:
+		return nil
+	case requests:
+		return quotaExceeded(subject, action+" requests", wait)
+	default:
+		return quotaExceeded(subject, action+" bytes", wait)
+	}
+}
+
+func (q *Quotas) allowConsume(ctx context.Context, res *api.ConsumeResponse) error {
+	subject := subject(ctx)
+	l := q.limiter(subject)
+	return q.take(subject, "consume bytes", l.consumeBytes, float64(proto.Size(res)))
+}
+
+// allowQuotaは、インターセプターを通らないHTTPとWebSocketのリクエストに
+// gRPCと同じクォータを適用する
+func (c *Config) allowQuota(ctx context.Context, action string, bytes float64) error {
+	if c.Quotas == nil {
+		return nil
+	}
+	return c.Quotas.allowRequest(ctx, action, bytes)
+}
+
+// allowConsumeRecordは、HTTPのストリームで送るレコードごとに、ConsumeStreamと同じく
+// 読み出すバイト数のクォータを適用する
+func (c *Config) allowConsumeRecord(ctx context.Context, record *api.Record) error {
+	if c.Quotas == nil {
+		return nil
+	}
+	return c.Quotas.allowConsume(ctx, &api.ConsumeResponse{Record: record})
+}
+
+// chargeConsumeは、HTTPで読み出したレコードのバイト数を、単項のConsumeと同じく後から計上する
+func (c *Config) chargeConsume(ctx context.Context, records ...*api.Record) {
+	if c.Quotas == nil {
+		return
+	}
+	var bytes int
+	for _, record := range records {
+		bytes += proto.Size(&api.ConsumeResponse{Record: record})
+	}
+	c.Quotas.limiter(subject(ctx)).consumeBytes.charge(c.Quotas.now(), float64(bytes))
+}
+
+// quotaExceededは、再試行までの待ち時間をRetryInfoに付けたResourceExhaustedのエラーを作る
+func quotaExceeded(subject, kind string, wait time.Duration) error {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("%s quota exceeded for %q, retry after %s", kind, subject, wait),
+	)
+	std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(wait),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
+
+// quotaActionは、メソッド名から制限の対象となるアクションを返す
+func quotaAction(fullMethod string) string {
+	switch fullMethod {
+	case api.Log_Produce_FullMethodName, api.Log_ProduceStream_FullMethodName:
+		return produceAction
+	case api.Log_Consume_FullMethodName, api.Log_ConsumeStream_FullMethodName:
+		return consumeAction
+	}
+	return ""
+}
+
+// UnaryServerInterceptorは、単項のProduceとConsumeにクォータを適用する
+func (q *Quotas) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		action := quotaAction(info.FullMethod)
+		if action == "" || forwarded(ctx) {
+			return handler(ctx, req)
+		}
+		var bytes float64
+		if req, ok := req.(*api.ProduceRequest); ok {
+			bytes = float64(proto.Size(req))
+		}
+		if err := q.allowRequest(ctx, action, bytes); err != nil {
+			return nil, err
+		}
+		res, err := handler(ctx, req)
+		if res, ok := res.(*api.ConsumeResponse); ok && err == nil {
+			// 読み出したバイト数は応答を作るまで分からないため、後から計上する
+			subject := subject(ctx)
+			q.limiter(subject).consumeBytes.charge(q.now(), float64(proto.Size(res)))
+		}
+		return res, err
+	}
+}
+
+// StreamServerInterceptorは、ストリームの開始をリクエストとして数え、
+// ProduceStreamでは受信したメッセージごとに、ConsumeStreamでは送信する
+// メッセージごとにクォータを適用する
+func (q *Quotas) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		action := quotaAction(info.FullMethod)
+		if action == "" || forwarded(stream.Context()) {
+			return handler(srv, stream)
+		}
+		if action == consumeAction {
+			if err := q.allowRequest(stream.Context(), action, 0); err != nil {
+				return err
+			}
+		}
+		return handler(srv, &quotaStream{ServerStream: stream, quotas: q})
+	}
+}
+
+type quotaStream struct {
+	grpc.ServerStream
+	quotas *Quotas
+}
+
+func (s *quotaStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if req, ok := m.(*api.ProduceRequest); ok {
+		return s.quotas.allowRequest(s.Context(), produceAction, float64(proto.Size(req)))
+	}
+	return nil
+}
+
+func (s *quotaStream) SendMsg(m interface{}) error {
+	if res, ok := m.(*api.ConsumeResponse); ok {
+		if err := s.quotas.allowConsume(s.Context(), res); err != nil {
+			return err
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// tokenBucketは、1秒あたりrateだけ補充され、最大でrateまで貯まるバケット
+// rateが0の場合は制限しない
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: math.Max(rate, 1),
+		last:   now,
+	}
+}
+
+// takeは、1以上残っている場合にnを取り出してtrueを返す。取り出した結果が
+// 負になった分は、以降の補充で返すまで次の取り出しを拒否する
+// 残りがない場合は、1だけ貯まるまでの時間とfalseを返す
+func (b *tokenBucket) take(now time.Time, n float64) (time.Duration, bool) {
+	if b.rate <= 0 {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if wait, ok := b.available(now); !ok {
+		return wait, false
+	}
+	b.tokens -= n
+	return 0, true
+}
+
+// availableは、補充した上で1以上残っているかを返す。bのロックを取って呼ぶ
+func (b *tokenBucket) available(now time.Time) (time.Duration, bool) {
+	if b.rate <= 0 {
+		return 0, true
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / b.rate * float64(time.Second)
+		return time.Duration(math.Ceil(wait)), false
+	}
+	return 0, true
+}
+
+// takeBothは、requestsとbytesの両方に1以上残っている場合だけ、requestsから1、
+// bytesからnを取り出す。残りがない場合は、待ち時間と足りないバケットを返す
+func takeBoth(now time.Time, requests, bytes *tokenBucket, n float64) (time.Duration, *tokenBucket) {
+	// デッドロックしないように、常にrequests、bytesの順にロックする
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+	bytes.mu.Lock()
+	defer bytes.mu.Unlock()
+
+	for _, b := range []*tokenBucket{requests, bytes} {
+		if wait, ok := b.available(now); !ok {
+			return wait, b
+		}
+	}
+	if requests.rate > 0 {
+		requests.tokens--
+	}
+	if bytes.rate > 0 {
+		bytes.tokens -= n
+	}
+	return 0, nil
+}
+
+// chargeは、残りに関わらずnを取り出す
+func (b *tokenBucket) charge(now time.Time, n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= n
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed*b.rate, math.Max(b.rate, 1))
+		b.last = now
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, now)
+
+	for i := 0; i < 2; i++ {
+		_, ok := b.take(now, 1)
+		require.True(t, ok)
+	}
+	wait, ok := b.take(now, 1)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// 補充されると再び取り出せる
+	now = now.Add(500 * time.Millisecond)
+	_, ok = b.take(now, 1)
+	require.True(t, ok)
+
+	// 1秒分を超える量も取り出せるが、借りを返すまで拒否する
+	now = now.Add(time.Second)
+	_, ok = b.take(now, 5)
+	require.True(t, ok)
+	wait, ok = b.take(now, 1)
+	require.False(t, ok)
+	require.Equal(t, 2*time.Second, wait)
+
+	unlimited := newTokenBucket(0, now)
+	for i := 0; i < 100; i++ {
+		_, ok := unlimited.take(now, 1000)
+		require.True(t, ok)
+	}
+}
+
+func TestQuotasPerSubject(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := NewQuotas(QuotaConfig{
+		Default: QuotaLimits{ProduceRequestsPerSecond: 1},
+		Subjects: map[string]QuotaLimits{
+			"root": {ProduceRequestsPerSecond: 10},
+		},
+	})
+	q.now = func() time.Time { return now }
+
+	ctx := func(subject string) context.Context {
+		return context.WithValue(context.Background(), subjectContextKey{}, subject)
+	}
+
+	require.NoError(t, q.allowRequest(ctx("nobody"), produceAction, 0))
+	err := q.allowRequest(ctx("nobody"), produceAction, 0)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	retry := retryDelay(t, err)
+	require.Equal(t, time.Second, retry)
+
+	// consumeは制限していない
+	require.NoError(t, q.allowRequest(ctx("nobody"), consumeAction, 0))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.allowRequest(ctx("root"), produceAction, 0))
+	}
+	require.Error(t, q.allowRequest(ctx("root"), produceAction, 0))
+}
+
+func TestQuotasRejectWithoutCharging(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := NewQuotas(QuotaConfig{
+		Default: QuotaLimits{ProduceRequestsPerSecond: 2, ProduceBytesPerSecond: 100},
+	})
+	q.now = func() time.Time { return now }
+	ctx := context.WithValue(context.Background(), subjectContextKey{}, "nobody")
+
+	// バイト数を使い切ると、リクエストの数を減らさずに拒否する
+	require.NoError(t, q.allowRequest(ctx, produceAction, 150))
+	for i := 0; i < 3; i++ {
+		err := q.allowRequest(ctx, produceAction, 1)
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "produce bytes")
+	}
+	now = now.Add(time.Second)
+	require.NoError(t, q.allowRequest(ctx, produceAction, 1))
+
+	// 転送されたリクエストは、転送元のノードで数えているので制限しない
+	forwardedCtx := context.WithValue(ctx, forwardedContextKey{}, true)
+	intercept := q.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: api.Log_Produce_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &api.ProduceResponse{}, nil
+	}
+	req := &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 200)}}
+	for i := 0; i < 5; i++ {
+		_, err := intercept(forwardedCtx, req, info, handler)
+		require.NoError(t, err)
+	}
+	_, err := intercept(ctx, req, info, handler)
+	require.NoError(t, err)
+	_, err = intercept(ctx, req, info, handler)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// 使われなくなったsubjectの制限は捨てる
+	now = now.Add(limiterIdleTimeout)
+	q.limiter("root")
+	require.Len(t, q.limiters, 1)
+	require.Contains(t, q.limiters, "root")
+}
+
+func TestQuotasEnforcedOnRPCs(t *testing.T) {
+	addr, cfg, _, teardown := setupTest(t, func(c *Config) {
+		c.Quotas = NewQuotas(QuotaConfig{
+			Default: QuotaLimits{
+				ProduceRequestsPerSecond: 1,
+				ConsumeBytesPerSecond:    1,
+			},
+		})
+	})
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	_, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Greater(t, retryDelay(t, err), time.Duration(0))
+
+	// 1件読み出すと1秒あたりのバイト数を使い切るため、ストリームは次の送信で終わる
+	_, err = cfg.CommitLog.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, req.Record.Value, res.Record.Value)
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func retryDelay(t *testing.T, err error) time.Duration {
+	t.Helper()
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	t.Fatal("no retry info in error")
+	return 0
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/tukki0210/proglog/api/v1"
+)
+
+// Replicasは、リーダーでフォロワーごとに複製が済んだオフセットを記録する
+type Replicas struct {
+	mu sync.Mutex
+	// nextは、フォロワーが次に追記するオフセット
+	next map[string]uint64
+	// changedは、いずれかのフォロワーが進むと閉じて作り直す
+	changed chan struct{}
+}
+
+func NewReplicas() *Replicas {
+	return &Replicas{
+		next:    make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *Replicas) ack(node string, next uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if next <= r.next[node] {
+		return
+	}
+	r.next[node] = next
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Waitは、nodeのフォロワーがoffsetのレコードを複製するか、ctxが終わるまで待つ
+func (r *Replicas) Wait(ctx context.Context, node string, offset uint64) error {
+	for {
+		r.mu.Lock()
+		replicated := r.next[node] > offset
+		changed := r.changed
+		r.mu.Unlock()
+		if replicated {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// RecordChecksumは、リーダーとフォロワーで同じオフセットのレコードが一致するかを比べるチェックサム
+func RecordChecksum(record *api.Record) ([]byte, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+type replicationServer struct {
+	api.UnimplementedReplicationServer
+	*Config
+}
+
+var _ api.ReplicationServer = (*replicationServer)(nil)
+
+// Replicateは、フォロワーが伝えたオフセットから、リーダーのログを送り続ける
+// 複製は利用者の読み出しではないので、ACLと監査ログとクォータの代わりに、
+// TrustedForwardersのノードの証明書だけに許可する
+func (s *replicationServer) Replicate(stream api.Replication_ReplicateServer) error {
+	ctx := stream.Context()
+	if !s.trustedForwarder(ctx) {
+		return status.Error(codes.PermissionDenied, "replication requires a node certificate")
+	}
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if err := s.verifyReplica(req.NextOffset, req.Checksum); err != nil {
+		return err
+	}
+	node, offset := req.Node, req.NextOffset
+	s.Replicas.ack(node, offset)
+
+	// フォロワーは追記するたびに次のオフセットを送ってくる
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				acks <- err
+				return
+			}
+			s.Replicas.ack(node, req.NextOffset)
+		}
+	}()
+
+	caughtUp := false
+	for {
+		record, err := s.CommitLog.Read(offset)
+		switch err.(type) {
+		case nil:
+			if err := stream.Send(&api.ReplicateResponse{Record: record}); err != nil {
+				return err
+			}
+			caughtUp = false
+			offset++
+			continue
+		case api.ErrOffsetOutOfRange:
+		default:
+			return err
+		}
+		// 送る前に切り詰められた場合は、フォロワーはもう追いつけない
+		if lowest := s.lowestOffset(); offset < lowest {
+			return truncatedForReplica(offset, lowest)
+		}
+		if !caughtUp {
+			if err := stream.Send(&api.ReplicateResponse{}); err != nil {
+				return err
+			}
+			caughtUp = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.draining():
+			return errDraining
+		case err := <-acks:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// verifyReplicaは、フォロワーのログがリーダーのログの先頭部分と一致するかを確かめる
+// リーダーが交代すると同じオフセットに別のレコードを書き込んでいることがあるので、
+// フォロワーの最後のレコードをチェックサムで比べ、食い違っていれば複製を拒否する
+func (c *Config) verifyReplica(next uint64, checksum []byte) error {
+	lowest := c.lowestOffset()
+	if next < lowest {
+		return truncatedForReplica(next, lowest)
+	}
+	if next == 0 {
+		return nil
+	}
+	record, err := c.CommitLog.Read(next - 1)
+	switch err.(type) {
+	case nil:
+	case api.ErrOffsetOutOfRange:
+		// 比べるレコードが切り詰められている場合も、一致を確かめられないので追いつけない
+		if next-1 < lowest {
+			return truncatedForReplica(next, lowest)
+		}
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"replica diverged: replica has records up to %d beyond the leader",
+			next-1,
+		)
+	default:
+		return err
+	}
+	sum, err := RecordChecksum(record)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, checksum) {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"replica diverged: record %d differs from the leader",
+			next-1,
+		)
+	}
+	return nil
+}
+
+// lowestOffsetは、最も古いレコードのオフセットを返す。分からない場合は0を返す
+func (c *Config) lowestOffset() uint64 {
+	l, ok := c.CommitLog.(lowestOffsetter)
+	if !ok {
+		return 0
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return 0
+	}
+	return lowest
+}
+
+func truncatedForReplica(next, lowest uint64) error {
+	return status.Errorf(
+		codes.OutOfRange,
+		"replica cannot catch up from %d: records before %d were truncated",
+		next,
+		lowest,
+	)
+}
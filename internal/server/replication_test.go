@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/config"
+	"github.com/tukki0210/proglog/internal/log"
+)
+
+func TestReplicate(t *testing.T) {
+	replicas := NewReplicas()
+	addr, cfg, _, teardown := setupTest(t, func(c *Config) {
+		c.Replicas = replicas
+		c.TrustedForwarders = []string{"node"}
+	})
+	defer teardown()
+
+	nodeConn, err := grpc.Dial(addr, testDialOptions(t,
+		config.NodeClientCertFile,
+		config.NodeClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer nodeConn.Close()
+	client := api.NewReplicationClient(nodeConn)
+
+	var records []*api.Record
+	for _, v := range []string{"first", "second"} {
+		record := &api.Record{Value: []byte(v)}
+		_, err := cfg.CommitLog.Append(record)
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 空のフォロワーには先頭から送り、末尾に追いついたらレコードのない応答を送る
+	stream, err := client.Replicate(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Node: "follower"}))
+	for i := range records {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+
+	// フォロワーが伝えたオフセットまで、複製を待てる
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	require.ErrorIs(t, replicas.Wait(waitCtx, "follower", 0), context.DeadlineExceeded)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{NextOffset: 2}))
+	require.NoError(t, replicas.Wait(ctx, "follower", 1))
+
+	replicate := func(client api.ReplicationClient, req *api.ReplicateRequest) error {
+		stream, err := client.Replicate(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(req))
+		_, err = stream.Recv()
+		return err
+	}
+
+	// 最後のレコードが一致するフォロワーには、続きから送る
+	sum, err := RecordChecksum(records[0])
+	require.NoError(t, err)
+	stream, err = client.Replicate(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Node: "follower", NextOffset: 1, Checksum: sum}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), res.Record.Value)
+
+	// 同じオフセットに別のレコードを持つフォロワーと、リーダーより進んだフォロワーは拒否する
+	sum, err = RecordChecksum(&api.Record{Value: []byte("other"), Offset: 0})
+	require.NoError(t, err)
+	err = replicate(client, &api.ReplicateRequest{Node: "follower", NextOffset: 1, Checksum: sum})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	err = replicate(client, &api.ReplicateRequest{Node: "follower", NextOffset: 5, Checksum: sum})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// ノードの証明書でなければ複製できない
+	rootConn, _ := dialTestClient(t, addr)
+	defer rootConn.Close()
+	err = replicate(api.NewReplicationClient(rootConn), &api.ReplicateRequest{Node: "root"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 切り詰めた範囲が必要なフォロワーは、追いつけないことを伝える
+	truncateLog(t, cfg.CommitLog.(*log.Log), 1)
+	err = replicate(client, &api.ReplicateRequest{Node: "follower"})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
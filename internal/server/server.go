@@ -5,8 +5,6 @@ import (
 	"strings"
 	"time"
 
-	"fmt"
-
 	api "github.com/tukki0210/proglog/api/v1"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -22,14 +20,49 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	CommitLog CommitLog
 	Authorizer Authorizer
+	GetServerer GetServerer
+	// LeaderFinderが設定されている場合、フォロワーは書き込みをリーダーに転送する
+	LeaderFinder LeaderFinder
+	// ForwardDialOptionsは、リーダーに接続するときのダイヤルオプション
+	ForwardDialOptions []grpc.DialOption
+	// TrustedForwardersは、転送元のクライアントのsubjectを引き継ぐことと、ログの複製を
+	// 許可するノードの証明書のコモンネームの一覧。証明書のOUにはconfig.NodeOUが必要
+	TrustedForwarders []string
+	// Healthが設定されている場合、grpc.health.v1のサービスを登録する
+	Health *Health
+	// EnableReflectionがtrueの場合、grpcurlなどのためにサーバーリフレクションを登録する
+	EnableReflection bool
+	// Drainerが設定されている場合、GracefulStopでストリームをドレインしてから停止する
+	Drainer *Drainer
+	// Quotasが設定されている場合、subjectごとにProduceとConsumeの流量を制限する
+	Quotas *Quotas
+	// AdminLogが設定されている場合、ログの保守のためのAdminサービスを登録する
+	AdminLog AdminLog
+	// ReplicationWaiterが設定されている場合、ACKS_ALLの書き込みはレプリケーションを待つ
+	ReplicationWaiter ReplicationWaiter
+	// Replicasが設定されている場合、フォロワーがログを複製するReplicationサービスを登録する
+	Replicas *Replicas
+	// AckTimeoutは、ACKS_ALLでリクエストがタイムアウトを指定しないときの待ち時間
+	AckTimeout time.Duration
+	// PolicyManagerが設定されている場合、AdminサービスでACLのポリシーを変更できる
+	PolicyManager PolicyManager
+	// PolicyBroadcasterは、ポリシーの変更を他のノードに伝える
+	PolicyBroadcaster Broadcaster
+	// Authenticatorsは、順に試すクライアントの認証方式。省略時はクライアント証明書で認証する
+	Authenticators []Authenticator
+	// AuditLogが設定されている場合、全ての認可の判断を記録する
+	AuditLog AuditLog
+
+	// forwarderは、リーダーへの接続。GracefulStopで閉じる
+	forwarder *forwarder
 }
 
 const (
@@ -59,7 +92,13 @@ type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// GetServererは、クラスタを構成するサーバーの一覧を返す
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
+}
+
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	config.initForwarder()
 	srv = &grpcServer{
 		Config: config,
 	}
@@ -99,54 +138,139 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 		},
 	})
 
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(srv.authenticate),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(),
+		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
+		grpc_auth.UnaryServerInterceptor(srv.authenticate),
+	}
+	if config.Drainer != nil {
+		streamInterceptors = append(
+			streamInterceptors,
+			config.Drainer.StreamServerInterceptor(),
+		)
+	}
+	// クォータは認証したsubjectごとに適用するため、認証の後に置く
+	if config.Quotas != nil {
+		streamInterceptors = append(
+			streamInterceptors,
+			config.Quotas.StreamServerInterceptor(),
+		)
+		unaryInterceptors = append(
+			unaryInterceptors,
+			config.Quotas.UnaryServerInterceptor(),
+		)
+	}
+
 	grpcOpts = append(grpcOpts, grpc.StreamInterceptor(
 		// ミドルウェアを追加するために、grpc_middlewareパッケージのChainStreamServer関数を呼び出す
-		grpc_middleware.ChainStreamServer(
-			grpc_ctxtags.StreamServerInterceptor(),
-			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
-	)), grpc.UnaryInterceptor(
-		grpc_middleware.ChainUnaryServer(
-			grpc_ctxtags.UnaryServerInterceptor(),
-			grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-			grpc_auth.UnaryServerInterceptor(authenticate),
-	)),
+		grpc_middleware.ChainStreamServer(streamInterceptors...),
+	), grpc.UnaryInterceptor(
+		grpc_middleware.ChainUnaryServer(unaryInterceptors...),
+	),
 	grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 	)
 
 	gsrv := grpc.NewServer(grpcOpts...)
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
 	api.RegisterLogServer(gsrv, srv)
+	if config.AdminLog != nil || config.PolicyManager != nil || config.AuditLog != nil {
+		api.RegisterAdminServer(gsrv, newAdminServer(config))
+	}
+	if config.Replicas != nil {
+		api.RegisterReplicationServer(gsrv, &replicationServer{Config: config})
+	}
+	if config.Health != nil {
+		healthpb.RegisterHealthServer(gsrv, config.Health)
+	}
+	if config.EnableReflection {
+		reflection.Register(gsrv)
+	}
 	return gsrv, nil
 }
 
 // クライアントがサーバへログを書き込むためのメソッド
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := s.authorize(ctx, object(req.Topic), produceAction); err != nil {
+		return nil, err
+	}
+	res, err := s.produce(ctx, req)
+	var offsets *api.OffsetRange
+	if err == nil {
+		offsets = offsetRange(res.Offset, res.Offset)
+	}
+	s.auditAllowed(ctx, object(req.Topic), produceAction, offsets)
+	return res, err
+}
+
+// produceは、認可したリクエストをリーダーに転送するかログに書き込む
+// HTTPとWebSocketの書き込みも、転送、acks、トピックの扱いを揃えるためにこれを使う
+func (c *Config) produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	if c.LeaderFinder != nil {
+		addr, local, err := c.LeaderFinder.Leader()
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Unavailable,
+				"failed to find leader: %v",
+				err,
+			)
+		}
+		// フォロワーは、呼び出し元のsubjectを付けてリーダーに書き込みを転送する
+		if !local {
+			return c.forwarder.Produce(ctx, addr, req)
+		}
+	}
+	// acksを満たすのはリーダーなので、リーダーだけが確認する
+	if err := c.checkAcks(req.Acks); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	req.Record.Topic = req.Topic
+	offset, err := c.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.waitAcks(ctx, req, offset); err != nil {
+		return nil, err
+	}
 
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
 // クライアントがサーバからログを読み込むためのメソッド
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	res, err := s.consume(ctx, req)
+	if status.Code(err) == codes.PermissionDenied {
+		return nil, err
+	}
+	if err == nil && !inTopic(res.Record, req.Topic) {
+		err = notInTopic(req.Offset, req.Topic)
+	}
+	var offsets *api.OffsetRange
+	if err == nil {
+		offsets = offsetRange(req.Offset, req.Offset)
+	}
+	s.auditAllowed(ctx, object(req.Topic), consumeAction, offsets)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// consumeは、トピックに関係なくオフセットのレコードを読み出す
+// 拒否した場合だけを監査ログに記録し、許可した場合は呼び出し元が記録する
+func (s *grpcServer) consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, object(req.Topic), consumeAction); err != nil {
 		return nil, err
 	}
 	record, err := s.CommitLog.Read(req.Offset)
@@ -157,29 +281,60 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
-func authenticate(ctx context.Context)(context.Context, error) {
-	// peer.FromContext()は、コンテキストからgRPCのpeer情報を取得する
-	// fmt.Println(ctx)
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(
-			codes.Unknown,
-			"could not get peer from context",
-		).Err()
+// objectは、トピックを認可の対象にする。トピックが空の場合はログ全体を対象にする
+func object(topic string) string {
+	if topic == "" {
+		return objectWildcard
 	}
+	return topic
+}
 
-	// TLS認証が成功していない場合は、Err()がnilではないエラーを返す
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
-	}
+// inTopicは、レコードが読み出すトピックに含まれるかを返す
+func inTopic(record *api.Record, topic string) bool {
+	return topic == "" || record.Topic == topic
+}
 
-	// TLS認証が成功している場合は、キャストしてsubjectを取得する
-	fmt.Println(peer.AuthInfo)
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
+func notInTopic(offset uint64, topic string) error {
+	return status.Errorf(
+		codes.NotFound,
+		"record %d is not in topic %q",
+		offset,
+		topic,
+	)
+}
 
-	return ctx, nil
+// readFromは、ストリームのためにoffsetのレコードを読み、次に読むオフセットを返す
+// 切り詰められた範囲は読めないまま末尾で待ち続けることになるので、最も古いレコードから読む
+func (c *Config) readFrom(offset uint64) (*api.Record, uint64, error) {
+	record, err := c.CommitLog.Read(offset)
+	l, ok := c.CommitLog.(lowestOffsetter)
+	if _, outOfRange := err.(api.ErrOffsetOutOfRange); !outOfRange || !ok {
+		return record, offset, err
+	}
+	lowest, lerr := l.LowestOffset()
+	if lerr != nil {
+		return nil, offset, lerr
+	}
+	if offset >= lowest {
+		return nil, offset, err
+	}
+	record, err = c.CommitLog.Read(lowest)
+	return record, lowest, err
+}
+
+// クライアントがクラスタ内のサーバーを発見するためのメソッド
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if s.GetServerer == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"server discovery is not configured",
+		)
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
 }
 
 func subject(ctx context.Context) string {
@@ -193,17 +348,38 @@ type subjectContextKey struct{}
 func (s *grpcServer) ProduceStream(
 	stream api.Log_ProduceStreamServer,
 ) error {
-	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		res, err := s.Produce(stream.Context(), req)
-		if err != nil {
-			return err
+	// ドレインの通知を受け取れるように、別のゴルーチンで受信する
+	reqs := make(chan *api.ProduceRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
 		}
-		if err = stream.Send(res); err != nil {
+	}()
+
+	for {
+		select {
+		case <-s.draining():
+			return errDraining
+		case err := <-errc:
 			return err
+		case req := <-reqs:
+			res, err := s.Produce(stream.Context(), req)
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(res); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -212,22 +388,75 @@ func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	// 認可されていないクライアントに、フィルターをコンパイルさせない
+	if err := s.authorize(stream.Context(), object(req.Topic), consumeAction); err != nil {
+		return err
+	}
+	// HTTPのストリームと同じく、終了時に送ったレコードの範囲をまとめて記録する
+	var offsets *api.OffsetRange
+	defer func() {
+		s.auditAllowed(stream.Context(), object(req.Topic), consumeAction, offsets)
+	}()
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	// フィルターで読み飛ばして、まだ進捗を知らせていないレコードの数
+	var skipped int
+	progress := func() error {
+		skipped = 0
+		return stream.Send(&api.ConsumeResponse{ScannedOffset: req.Offset - 1})
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.draining():
+			return errDraining
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			record, offset, err := s.readFrom(req.Offset)
+			req.Offset = offset
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// 末尾に追いついたら、読み飛ばした分の進捗を知らせてから待つ
+				if skipped > 0 {
+					if err := progress(); err != nil {
+						return err
+					}
+				}
+				// ログは追記を通知しないので、少し待ってから読み直す
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-s.draining():
+					return errDraining
+				case <-time.After(streamPollInterval):
+				}
 				continue
 			default:
 				return err
 			}
+			// 他のトピックのレコードは、フィルターに一致しない場合と同じく読み飛ばす
+			if !inTopic(record, req.Topic) || !filter.match(record) {
+				req.Offset++
+				if skipped++; skipped >= filterProgressInterval {
+					if err := progress(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			// ストリームの途中でポリシーが変わることがあるので、送るレコードごとに認可する
+			if err := s.authorize(stream.Context(), object(req.Topic), consumeAction); err != nil {
+				return err
+			}
+			res := &api.ConsumeResponse{Record: record, ScannedOffset: req.Offset}
 			if err = stream.Send(res); err != nil {
 				return err
 			}
+			offsets = extend(offsets, req.Offset)
+			skipped = 0
 			req.Offset++
 		}
 	}
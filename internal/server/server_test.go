@@ -12,14 +12,18 @@ import (
 
 	"github.com/stretchr/testify/require"
 	api "github.com/tukki0210/proglog/api/v1"
+	"github.com/tukki0210/proglog/internal/audit"
 	"github.com/tukki0210/proglog/internal/auth"
 	"github.com/tukki0210/proglog/internal/config"
 	"github.com/tukki0210/proglog/internal/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 
 	// "google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
 	"google.golang.org/grpc/status"
 
 	"go.opencensus.io/examples/exporter"
@@ -52,7 +56,9 @@ func TestServer(t *testing.T) {
 		// key:シナリオの説明、value:シナリオをテストするための関数
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"consume past log boundary fails":                    testConsumePastBoundary,
+		"produce without a record fails":                     testProduceWithoutRecord,
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
+		"consume stream skips truncated records":             testConsumeStreamTruncated,
 		"unauthorized fails":                                 testUnauthorized,
 	} {
 		// forループの中
@@ -62,20 +68,29 @@ func TestServer(t *testing.T) {
 			// 第２引数：テストケースの実行内容
 			func(t *testing.T) {
 				// 各シナリオの設定を行う
-				rootClient, nobodyClient, config, teardown := setupTest(t, nil)
+				addr, cfg, _, teardown := setupTest(t, nil)
 				// テストが終わった後のクリーンアップを行う
 				defer teardown()
+				rootConn, rootClient := dialTestClient(t, addr)
+				defer rootConn.Close()
+				nobodyConn, err := grpc.Dial(addr, testDialOptions(t,
+					config.NobodyClientCertFile,
+					config.NobodyClientKeyFile,
+				)...)
+				require.NoError(t, err)
+				defer nobodyConn.Close()
 				// 具体的なテストシナリオの実行
-				fn(t, rootClient, nobodyClient, config)
+				fn(t, rootClient, api.NewLogClient(nobodyConn), cfg)
 			})
 	}
 }
 
+// setupTestは、一時ディレクトリのログを使うサーバーを起動する
 func setupTest(t *testing.T, fn func(*Config)) (
 	// 戻り値
-	rootClient api.LogClient,
-	nobodyClient api.LogClient,
+	addr string,
 	cfg *Config,
+	server *grpc.Server,
 	teardown func(),
 ) {
 	t.Helper()
@@ -83,42 +98,6 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
-	// クライアントのTLS設定
-
-	newClient := func(certPath, keyPath string) (
-		*grpc.ClientConn,
-		api.LogClient,
-		[]grpc.DialOption,
-	) {
-		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
-			CAFile:   config.CAFile,
-			CertFile: certPath,
-			KeyFile:  keyPath,
-			Server:   false,
-		})
-		require.NoError(t, err)
-		tlsCreds := credentials.NewTLS(tlsConfig)
-		opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
-		conn, err := grpc.Dial(l.Addr().String(), opts...)
-		require.NoError(t, err)
-		client := api.NewLogClient(conn)
-		return conn, client, opts
-	}
-
-	// rootユーザーのクライアント
-	var rootConn *grpc.ClientConn
-	rootConn, rootClient, _ = newClient(
-		config.RootClientCertFile,
-		config.RootClientKeyFile,
-	)
-
-	// nobodyユーザーのクライアント
-	var nobodyConn *grpc.ClientConn
-	nobodyConn, nobodyClient, _ = newClient(
-		config.NobodyClientCertFile,
-		config.NobodyClientKeyFile,
-	)
-
 	// サーバーのTLS設定
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
@@ -169,18 +148,17 @@ func setupTest(t *testing.T, fn func(*Config)) (
 			require.NoError(t, err)
 	}
 
-	server, err := NewGRPCServer(cfg, grpc.Creds(serverCreds))
+	server, err = NewGRPCServer(cfg, grpc.Creds(serverCreds))
 	require.NoError(t, err)
 
 	go func() {
 		server.Serve(l)
 	}()
 
-	return rootClient, nobodyClient, cfg, func() {
-		rootConn.Close()
-		nobodyConn.Close()
+	return l.Addr().String(), cfg, server, func() {
 		server.Stop()
 		l.Close()
+		clog.Remove()
 		if telemetryExporter != nil {
 			time.Sleep(1500 * time.Millisecond)
 			telemetryExporter.Stop()
@@ -216,6 +194,19 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.Equal(t, want.Offset, consume.Record.Offset)
 }
 
+func testProduceWithoutRecord(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func testConsumePastBoundary(
 	t *testing.T,
 	client, _ api.LogClient,
@@ -296,6 +287,34 @@ func testProduceConsumeStream(
 	}
 }
 
+// 切り詰めた範囲から読み始めても、末尾で待たずに残っている最も古いレコードから送る
+func testConsumeStreamTruncated(t *testing.T, client, _ api.LogClient, config *Config) {
+	clog := config.CommitLog.(*log.Log)
+	truncateLog(t, clog, 3)
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+}
+
+// truncateLogは、n件のレコードを書き込んでからそれまでのレコードを全て切り詰め、
+// 次のオフセットに1件書き込む
+func truncateLog(t *testing.T, clog *log.Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("truncated")})
+		require.NoError(t, err)
+	}
+	next := clog.NextOffset()
+	_, err := clog.Roll()
+	require.NoError(t, err)
+	require.NoError(t, clog.Truncate(next-1))
+	_, err = clog.Append(&api.Record{Value: []byte("after truncate")})
+	require.NoError(t, err)
+}
+
 func testUnauthorized(
 	t *testing.T,
 	_,
@@ -333,3 +352,362 @@ func testUnauthorized(
 		t.Fatalf("got code: %s, want: %s", gotCode, wantCode)
 	}
 }
+
+// フォロワーに書き込んだレコードが、呼び出し元のsubjectのままリーダーに転送されることを確認する
+func TestProduceForwardedToLeader(t *testing.T) {
+	newAuditLog := func() *audit.Log {
+		auditLog, err := audit.New(t.TempDir(), audit.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { auditLog.Close() })
+		return auditLog
+	}
+	leaderAudit, followerAudit := newAuditLog(), newAuditLog()
+	leaderAddr, leaderCfg, _, teardownLeader := setupTest(t, func(c *Config) {
+		c.AuditLog = leaderAudit
+		c.LeaderFinder = &leaderFinder{local: true}
+		// nobodyはNodeOUの証明書ではないので、転送元として信頼しない
+		c.TrustedForwarders = []string{"node", "nobody"}
+	})
+	defer teardownLeader()
+
+	forwardOpts := testDialOptions(t,
+		config.NodeClientCertFile,
+		config.NodeClientKeyFile,
+	)
+	followerAddr, followerCfg, followerSrv, teardownFollower := setupTest(t, func(c *Config) {
+		c.LeaderFinder = &leaderFinder{addr: leaderAddr}
+		c.ForwardDialOptions = forwardOpts
+		c.AuditLog = followerAudit
+		// リーダーでの認可を確認するため、フォロワーでは全て許可する
+		c.Authorizer = allowAll{}
+	})
+	defer teardownFollower()
+
+	rootConn, rootClient := dialTestClient(t, followerAddr)
+	defer rootConn.Close()
+
+	nobodyConn, err := grpc.Dial(followerAddr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer nobodyConn.Close()
+	nobodyClient := api.NewLogClient(nobodyConn)
+
+	ctx := context.Background()
+	want := []byte("hello world")
+	produce, err := rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: want},
+	})
+	require.NoError(t, err)
+
+	record, err := leaderCfg.CommitLog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, want, record.Value)
+	_, err = followerCfg.CommitLog.Read(produce.Offset)
+	require.Error(t, err)
+
+	stream, err := rootClient.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: want},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, res.Offset)
+
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: want},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 転送した書き込みはフォロワーだけが記録し、リーダーは拒否したものだけを記録する
+	events, err := followerAudit.Query(time.Time{}, time.Time{}, "root", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for i, e := range events {
+		require.Equal(t, produce.Offset+uint64(i), e.Offsets.First)
+	}
+	events, err = leaderAudit.Query(time.Time{}, time.Time{}, "", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "nobody", events[0].Subject)
+	require.False(t, events[0].Allowed)
+
+	// 停止するとリーダーへの接続を閉じる
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+	require.NoError(t, GracefulStop(ctx, followerSrv, followerCfg))
+	require.Nil(t, followerCfg.forwarder.conn)
+
+	// ノードの証明書でないクライアントは、転送元のsubjectを名乗れない
+	leaderConn, err := grpc.Dial(leaderAddr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer leaderConn.Close()
+	_, err = api.NewLogClient(leaderConn).Produce(
+		metadata.AppendToOutgoingContext(ctx, forwardedSubjectKey, "root"),
+		&api.ProduceRequest{Record: &api.Record{Value: want}},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestHealthAndReflection(t *testing.T) {
+	health := NewHealth(HealthLog, HealthMembership)
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Health = health
+		c.EnableReflection = true
+	})
+	defer teardown()
+
+	conn, _ := dialTestClient(t, addr)
+	defer conn.Close()
+
+	ctx := context.Background()
+	client := healthpb.NewHealthClient(conn)
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{
+			Service: service,
+		})
+		require.NoError(t, err)
+		return res.Status
+	}
+
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	health.SetHealthy(HealthLog, true)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(HealthLog))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(HealthMembership))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check("log.v1.Log"))
+	health.SetHealthy(HealthMembership, true)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check("log.v1.Log"))
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	var services []string
+	for _, s := range res.GetListServicesResponse().Service {
+		services = append(services, s.Name)
+	}
+	require.Contains(t, services, "log.v1.Log")
+	require.Contains(t, services, "grpc.health.v1.Health")
+}
+
+// dialTestClientは、rootクライアントとしてaddrのサーバーに接続する
+func dialTestClient(t *testing.T, addr string) (*grpc.ClientConn, api.LogClient) {
+	t.Helper()
+	conn, err := grpc.Dial(addr, testDialOptions(t,
+		config.RootClientCertFile,
+		config.RootClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	return conn, api.NewLogClient(conn)
+}
+
+type leaderFinder struct {
+	addr  string
+	local bool
+}
+
+func (f *leaderFinder) Leader() (string, bool, error) {
+	return f.addr, f.local, nil
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
+}
+
+func testDialOptions(t *testing.T, certPath, keyPath string) []grpc.DialOption {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:   config.CAFile,
+		CertFile: certPath,
+		KeyFile:  keyPath,
+		Server:   false,
+	})
+	require.NoError(t, err)
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	}
+}
+
+func TestGracefulStopDrainsStreams(t *testing.T) {
+	drainer := NewDrainer()
+	addr, cfg, gsrv, teardown := setupTest(t, func(c *Config) {
+		c.Drainer = drainer
+	})
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	ctx := context.Background()
+	// 新しいレコードを待っているストリームと、次の書き込みを待っているストリーム
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = produce.Recv()
+	require.NoError(t, err)
+	_, err = consume.Recv()
+	require.NoError(t, err)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		stopped <- GracefulStop(ctx, gsrv, cfg)
+	}()
+
+	_, err = consume.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = produce.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("graceful stop did not finish")
+	}
+}
+
+// ヘルスチェックのWatchは、開いたままでもGracefulStopを待たせない
+func TestGracefulStopWithHealthWatch(t *testing.T) {
+	health := NewHealth(HealthLog)
+	health.SetHealthy(HealthLog, true)
+	addr, cfg, gsrv, teardown := setupTest(t, func(c *Config) {
+		c.Drainer = NewDrainer()
+		c.Health = health
+	})
+	defer teardown()
+
+	conn, _ := dialTestClient(t, addr)
+	defer conn.Close()
+	ctx := context.Background()
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, GracefulStop(stopCtx, gsrv, cfg))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestDrainingRejectsNewStreams(t *testing.T) {
+	drainer := NewDrainer()
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Drainer = drainer
+	})
+	defer teardown()
+
+	conn, client := dialTestClient(t, addr)
+	defer conn.Close()
+
+	drainer.Drain()
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// 単項のRPCはサーバーが停止するまで受け付ける
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+}
+
+func TestTopicScopedACL(t *testing.T) {
+	// nobodyは、ordersに書き込めるがevents.*からしか読み出せない
+	policy, err := os.CreateTemp("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policy.Name())
+	_, err = policy.WriteString(`p, root, *, produce
+p, root, *, consume
+p, nobody, orders, produce
+p, nobody, events.*, consume
+`)
+	require.NoError(t, err)
+	require.NoError(t, policy.Close())
+
+	addr, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = auth.New(config.ACLModelFile, policy.Name())
+	})
+	defer teardown()
+
+	rootConn, root := dialTestClient(t, addr)
+	defer rootConn.Close()
+	nobodyConn, err := grpc.Dial(addr, testDialOptions(t,
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)...)
+	require.NoError(t, err)
+	defer nobodyConn.Close()
+	nobody := api.NewLogClient(nobodyConn)
+
+	ctx := context.Background()
+	produce := func(client api.LogClient, topic string) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte(topic)},
+		})
+	}
+
+	res, err := produce(nobody, "orders")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	_, err = produce(nobody, "events.clicks")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	// トピックがない場合はログ全体への権限が必要
+	_, err = produce(nobody, "")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	res, err = produce(root, "events.clicks")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	consumed, err := nobody.Consume(ctx, &api.ConsumeRequest{Topic: "events.clicks", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, "events.clicks", consumed.Record.Topic)
+	// 他のトピックのレコードは読み出せない
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Topic: "events.clicks", Offset: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "events.clicks"})
+	require.NoError(t, err)
+	streamed, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), streamed.Record.Offset)
+
+	// 認可されていないクライアントのフィルターはコンパイルせずに拒否する
+	denied, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:  "orders",
+		Filter: &api.Filter{Expression: "headers.type =="},
+	})
+	require.NoError(t, err)
+	_, err = denied.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	consumed, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, "orders", consumed.Record.Topic)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// SubjectSourceは、クライアント証明書のどの値をsubjectにするか
+type SubjectSource int
+
+const (
+	// SubjectCommonNameは、サブジェクトのコモンネーム
+	SubjectCommonName SubjectSource = iota
+	// SubjectDNSNameは、SANのDNS名
+	SubjectDNSName
+	// SubjectURIは、SANのURI。SPIFFE IDはここに入る
+	SubjectURI
+)
+
+func (s SubjectSource) String() string {
+	switch s {
+	case SubjectCommonName:
+		return "cn"
+	case SubjectDNSName:
+		return "dns"
+	case SubjectURI:
+		return "uri"
+	}
+	return fmt.Sprintf("SubjectSource(%d)", int(s))
+}
+
+// ParseSubjectSourceは、設定ファイルなどで使う名前からSubjectSourceを返す
+func ParseSubjectSource(name string) (SubjectSource, error) {
+	for _, s := range []SubjectSource{SubjectCommonName, SubjectDNSName, SubjectURI} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown subject source %q", name)
+}
+
+// SubjectMappingは、クライアント証明書からsubjectを取り出す規則
+type SubjectMapping struct {
+	Source SubjectSource
+	// Patternが設定されている場合、一致する値だけを使う
+	Pattern *regexp.Regexp
+	// Replacementは、Patternに一致した値から$1などを展開してsubjectにする
+	// 空の場合は値をそのまま使う
+	Replacement string
+}
+
+// SPIFFEMappingは、spiffe://<trustDomain>/... のURI SANのパスをsubjectにする規則
+// 例えば spiffe://example.org/ns/prod/sa/api は ns/prod/sa/api になる
+func SPIFFEMapping(trustDomain string) SubjectMapping {
+	return SubjectMapping{
+		Source:      SubjectURI,
+		Pattern:     regexp.MustCompile(`^spiffe://` + regexp.QuoteMeta(trustDomain) + `/(.+)$`),
+		Replacement: "$1",
+	}
+}
+
+// defaultSubjectMappingsは、これまで通りコモンネームをsubjectにする
+var defaultSubjectMappings = []SubjectMapping{{Source: SubjectCommonName}}
+
+func (m SubjectMapping) values(cert *x509.Certificate) []string {
+	switch m.Source {
+	case SubjectCommonName:
+		return []string{cert.Subject.CommonName}
+	case SubjectDNSName:
+		return cert.DNSNames
+	case SubjectURI:
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	}
+	return nil
+}
+
+func (m SubjectMapping) extract(cert *x509.Certificate) (string, bool) {
+	for _, v := range m.values(cert) {
+		if v == "" {
+			continue
+		}
+		if m.Pattern == nil {
+			return v, true
+		}
+		match := m.Pattern.FindStringSubmatchIndex(v)
+		if match == nil {
+			continue
+		}
+		if m.Replacement == "" {
+			return v, true
+		}
+		subject := m.Pattern.ExpandString(nil, m.Replacement, v, match)
+		if len(subject) > 0 {
+			return string(subject), true
+		}
+	}
+	return "", false
+}
+
+// certificateSubjectは、最初に値を取り出せた規則のsubjectを返す
+func certificateSubject(cert *x509.Certificate, mappings []SubjectMapping) (string, error) {
+	if len(mappings) == 0 {
+		mappings = defaultSubjectMappings
+	}
+	for _, m := range mappings {
+		if subject, ok := m.extract(cert); ok {
+			return subject, nil
+		}
+	}
+	return "", errors.New("client certificate has no identity matching the subject mappings")
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateSubject(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.org/ns/prod/sa/api")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "root"},
+		DNSNames: []string{"api.internal", "api.prod.example.org"},
+		URIs:     []*url.URL{spiffe},
+	}
+
+	for name, tc := range map[string]struct {
+		mappings []SubjectMapping
+		want     string
+	}{
+		"common name by default": {nil, "root"},
+		"first dns name": {
+			[]SubjectMapping{{Source: SubjectDNSName}},
+			"api.internal",
+		},
+		"dns name matching a pattern": {
+			[]SubjectMapping{{
+				Source:      SubjectDNSName,
+				Pattern:     regexp.MustCompile(`^([^.]+)\.prod\.example\.org$`),
+				Replacement: "prod-$1",
+			}},
+			"prod-api",
+		},
+		"spiffe id": {
+			[]SubjectMapping{SPIFFEMapping("example.org")},
+			"ns/prod/sa/api",
+		},
+		"falls back to the next mapping": {
+			[]SubjectMapping{
+				SPIFFEMapping("other.org"),
+				{Source: SubjectCommonName},
+			},
+			"root",
+		},
+	} {
+		subject, err := certificateSubject(cert, tc.mappings)
+		require.NoError(t, err, name)
+		require.Equal(t, tc.want, subject, name)
+	}
+
+	// 一致する規則がない証明書は認証しない
+	_, err = certificateSubject(cert, []SubjectMapping{SPIFFEMapping("other.org")})
+	require.Error(t, err)
+
+	source, err := ParseSubjectSource("uri")
+	require.NoError(t, err)
+	require.Equal(t, SubjectURI, source)
+	_, err = ParseSubjectSource("email")
+	require.Error(t, err)
+}